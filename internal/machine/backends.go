@@ -0,0 +1,262 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapi_alpha "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+// backendServiceField indexes routes by the Services they refer to.
+const backendServiceField = ".spec.rules.backendRefs.service"
+
+func backendServiceIndexer(obj client.Object) []string {
+	var backendRefs []gatewayapi.BackendObjectReference
+	switch route := obj.(type) {
+	case *gatewayapi_alpha.TCPRoute:
+		for _, rule := range route.Spec.Rules {
+			for _, backendRef := range rule.BackendRefs {
+				backendRefs = append(backendRefs, backendRef.BackendObjectReference)
+			}
+		}
+	case *gatewayapi.HTTPRoute:
+		for _, rule := range route.Spec.Rules {
+			for _, backendRef := range rule.BackendRefs {
+				backendRefs = append(backendRefs, backendRef.BackendObjectReference)
+			}
+		}
+	}
+
+	var services []string
+	for _, backendRef := range backendRefs {
+		if !isServiceRef(backendRef) {
+			continue
+		}
+		namespace := obj.GetNamespace()
+		if backendRef.Namespace != nil {
+			namespace = string(*backendRef.Namespace)
+		}
+		services = append(services, types.NamespacedName{Namespace: namespace, Name: string(backendRef.Name)}.String())
+	}
+	return services
+}
+
+// serviceKey returns the index key of the Service obj belongs to, which is
+// either a Service or an EndpointSlice.
+func serviceKey(obj client.Object) (string, bool) {
+	if _, ok := obj.(*discoveryv1.EndpointSlice); ok {
+		name, ok := obj.GetLabels()[discoveryv1.LabelServiceName]
+		return types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}.String(), ok
+	}
+	return client.ObjectKeyFromObject(obj).String(), true
+}
+
+func isServiceRef(backendRef gatewayapi.BackendObjectReference) bool {
+	return (backendRef.Kind == nil || *backendRef.Kind == "Service") &&
+		(backendRef.Group == nil || *backendRef.Group == "")
+}
+
+// weightedBackend is a backendRef with all the addresses it resolved to.
+type weightedBackend struct {
+	addresses []string
+	weight    int32
+}
+
+// pickBackend chooses one of backends at random according to their weights
+// and one of its addresses.
+func pickBackend(backends []weightedBackend) (string, bool) {
+	var total int64
+	for _, backend := range backends {
+		if len(backend.addresses) > 0 {
+			total += int64(backend.weight)
+		}
+	}
+	if total == 0 {
+		return "", false
+	}
+	n := rand.Int63n(total)
+	for _, backend := range backends {
+		if len(backend.addresses) == 0 {
+			continue
+		}
+		n -= int64(backend.weight)
+		if n < 0 {
+			return backend.addresses[rand.Intn(len(backend.addresses))], true
+		}
+	}
+	return "", false
+}
+
+// backendPermitted checks whether a route of routeKind in routeNamespace may
+// refer to backend. Backends in other namespaces need a ReferenceGrant.
+func (ctrlr *routeController) backendPermitted(
+	ctx context.Context,
+	routeKind gatewayapi.Kind,
+	routeNamespace string,
+	backend gatewayapi.BackendObjectReference,
+) (bool, error) {
+	if backend.Namespace == nil || string(*backend.Namespace) == routeNamespace {
+		return true, nil
+	}
+
+	grants := gatewayapi.ReferenceGrantList{}
+	if err := ctrlr.List(ctx, &grants, client.InNamespace(string(*backend.Namespace))); err != nil {
+		return false, err
+	}
+
+	for _, grant := range grants.Items {
+		fromRoute := false
+		for _, from := range grant.Spec.From {
+			if from.Group == gatewayapi.GroupName && from.Kind == routeKind && string(from.Namespace) == routeNamespace {
+				fromRoute = true
+				break
+			}
+		}
+		if !fromRoute {
+			continue
+		}
+		for _, to := range grant.Spec.To {
+			if to.Group == "" && to.Kind == "Service" && (to.Name == nil || *to.Name == backend.Name) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// resolvedRefsCondition returns the ResolvedRefs condition for a route with
+// the given Services it isn't allowed to refer to and problems resolving its
+// other backendRefs.
+func resolvedRefsCondition(generation int64, notPermitted, unresolved []string) metav1.Condition {
+	resolvedRefs := metav1.Condition{
+		ObservedGeneration: generation,
+		Type:               string(gatewayapi.RouteConditionResolvedRefs),
+		Status:             metav1.ConditionTrue,
+		Reason:             string(gatewayapi.RouteReasonResolvedRefs),
+	}
+	switch {
+	case len(notPermitted) > 0:
+		resolvedRefs.Status = metav1.ConditionFalse
+		resolvedRefs.Reason = string(gatewayapi.RouteReasonRefNotPermitted)
+		resolvedRefs.Message = "no ReferenceGrant allows referring to Services: " + strings.Join(notPermitted, ", ")
+	case len(unresolved) > 0:
+		resolvedRefs.Status = metav1.ConditionFalse
+		resolvedRefs.Reason = string(gatewayapi.RouteReasonBackendNotFound)
+		resolvedRefs.Message = strings.Join(unresolved, ", ")
+	}
+	return resolvedRefs
+}
+
+// unresolvedError describes why a backendRef can't be resolved to any
+// address.
+type unresolvedError string
+
+func (err unresolvedError) Error() string {
+	return string(err)
+}
+
+// resolveBackend returns the addresses traffic for backend should be
+// forwarded to. ClusterIP Services are forwarded to their ClusterIP, headless
+// Services to their ready endpoints and ExternalName Services to their DNS
+// name. An unresolvedError is returned if the Service or its port doesn't
+// exist.
+func (ctrlr *routeController) resolveBackend(
+	ctx context.Context,
+	routeNamespace string,
+	backend gatewayapi.BackendObjectReference,
+) ([]string, error) {
+	namespace := routeNamespace
+	if backend.Namespace != nil {
+		namespace = string(*backend.Namespace)
+	}
+	if backend.Port == nil {
+		return nil, unresolvedError(fmt.Sprintf("Service %s/%s needs a port", namespace, backend.Name))
+	}
+	port := int32(*backend.Port)
+
+	svc := v1.Service{}
+	if err := ctrlr.Get(
+		ctx,
+		types.NamespacedName{Name: string(backend.Name), Namespace: namespace},
+		&svc,
+	); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, unresolvedError(fmt.Sprintf("Service %s/%s not found", namespace, backend.Name))
+		}
+		return nil, err
+	}
+
+	// ExternalName Services don't need to list their ports
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return []string{net.JoinHostPort(svc.Spec.ExternalName, strconv.Itoa(int(port)))}, nil
+	}
+
+	var servicePort *v1.ServicePort
+	for i := range svc.Spec.Ports {
+		if svc.Spec.Ports[i].Port == port {
+			servicePort = &svc.Spec.Ports[i]
+		}
+	}
+	if servicePort == nil {
+		return nil, unresolvedError(fmt.Sprintf("Service %s/%s has no port %d", namespace, backend.Name, port))
+	}
+
+	if svc.Spec.ClusterIP != v1.ClusterIPNone {
+		return []string{net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(port)))}, nil
+	}
+
+	return ctrlr.resolveEndpoints(ctx, &svc, servicePort)
+}
+
+// resolveEndpoints returns the addresses of the ready endpoints of the
+// headless Service svc for servicePort, whose targetPort is resolved by the
+// EndpointSlices.
+func (ctrlr *routeController) resolveEndpoints(
+	ctx context.Context,
+	svc *v1.Service,
+	servicePort *v1.ServicePort,
+) ([]string, error) {
+	slices := discoveryv1.EndpointSliceList{}
+	if err := ctrlr.List(
+		ctx, &slices, client.InNamespace(svc.Namespace), client.MatchingLabels{discoveryv1.LabelServiceName: svc.Name},
+	); err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, slice := range slices.Items {
+		var targetPort *int32
+		for _, port := range slice.Ports {
+			if port.Name != nil && *port.Name == servicePort.Name && port.Port != nil {
+				targetPort = port.Port
+			}
+		}
+		if targetPort == nil {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				addresses = append(addresses, net.JoinHostPort(address, strconv.Itoa(int(*targetPort))))
+			}
+		}
+	}
+	sort.Strings(addresses)
+
+	return addresses, nil
+}
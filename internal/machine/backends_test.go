@@ -0,0 +1,242 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+// testRouteController returns a routeController backed by a fake client
+// holding objs.
+func testRouteController(t *testing.T, objs ...client.Object) *routeController {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := gatewayapi.Install(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	return &routeController{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build(),
+		Logger: logr.Discard(),
+	}
+}
+
+func serviceRef(namespace *string, name string, port *int32) gatewayapi.BackendObjectReference {
+	return gatewayapi.BackendObjectReference{
+		Name:      gatewayapi.ObjectName(name),
+		Namespace: (*gatewayapi.Namespace)(namespace),
+		Port:      (*gatewayapi.PortNumber)(port),
+	}
+}
+
+func referenceGrant(namespace string, from gatewayapi.ReferenceGrantFrom, to gatewayapi.ReferenceGrantTo) *gatewayapi.ReferenceGrant {
+	return &gatewayapi.ReferenceGrant{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "grant"},
+		Spec: gatewayapi.ReferenceGrantSpec{
+			From: []gatewayapi.ReferenceGrantFrom{from},
+			To:   []gatewayapi.ReferenceGrantTo{to},
+		},
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+func TestBackendPermitted(t *testing.T) {
+	fromHTTPRoutes := gatewayapi.ReferenceGrantFrom{Group: gatewayapi.GroupName, Kind: "HTTPRoute", Namespace: "routes"}
+	toServices := gatewayapi.ReferenceGrantTo{Kind: "Service"}
+
+	cases := []struct {
+		name    string
+		objs    []client.Object
+		backend gatewayapi.BackendObjectReference
+		want    bool
+	}{{
+		name:    "same namespace implicitly",
+		backend: serviceRef(nil, "backend", nil),
+		want:    true,
+	}, {
+		name:    "same namespace explicitly",
+		backend: serviceRef(ptr("routes"), "backend", nil),
+		want:    true,
+	}, {
+		name:    "other namespace without ReferenceGrant",
+		backend: serviceRef(ptr("backends"), "backend", nil),
+	}, {
+		name:    "other namespace with ReferenceGrant for all Services",
+		objs:    []client.Object{referenceGrant("backends", fromHTTPRoutes, toServices)},
+		backend: serviceRef(ptr("backends"), "backend", nil),
+		want:    true,
+	}, {
+		name: "other namespace with ReferenceGrant for the Service",
+		objs: []client.Object{referenceGrant("backends", fromHTTPRoutes,
+			gatewayapi.ReferenceGrantTo{Kind: "Service", Name: ptr(gatewayapi.ObjectName("backend"))})},
+		backend: serviceRef(ptr("backends"), "backend", nil),
+		want:    true,
+	}, {
+		name: "other namespace with ReferenceGrant for another Service",
+		objs: []client.Object{referenceGrant("backends", fromHTTPRoutes,
+			gatewayapi.ReferenceGrantTo{Kind: "Service", Name: ptr(gatewayapi.ObjectName("other"))})},
+		backend: serviceRef(ptr("backends"), "backend", nil),
+	}, {
+		name: "ReferenceGrant for another route kind",
+		objs: []client.Object{referenceGrant("backends",
+			gatewayapi.ReferenceGrantFrom{Group: gatewayapi.GroupName, Kind: "TCPRoute", Namespace: "routes"}, toServices)},
+		backend: serviceRef(ptr("backends"), "backend", nil),
+	}, {
+		name: "ReferenceGrant for another route namespace",
+		objs: []client.Object{referenceGrant("backends",
+			gatewayapi.ReferenceGrantFrom{Group: gatewayapi.GroupName, Kind: "HTTPRoute", Namespace: "other"}, toServices)},
+		backend: serviceRef(ptr("backends"), "backend", nil),
+	}, {
+		name:    "ReferenceGrant in another namespace",
+		objs:    []client.Object{referenceGrant("other", fromHTTPRoutes, toServices)},
+		backend: serviceRef(ptr("backends"), "backend", nil),
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrlr := testRouteController(t, tc.objs...)
+
+			got, err := ctrlr.backendPermitted(context.Background(), "HTTPRoute", "routes", tc.backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveBackend(t *testing.T) {
+	clusterIP := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cluster-ip"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+	externalName := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "external"},
+		Spec: v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: "example.com",
+		},
+	}
+	headless := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "headless"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: v1.ClusterIPNone,
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80}},
+		},
+	}
+	headlessSlice := func(name string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name,
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "headless"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       []discoveryv1.EndpointPort{{Name: ptr("http"), Port: ptr(int32(8080))}},
+			Endpoints:   endpoints,
+		}
+	}
+	endpoint := func(address string, ready *bool) discoveryv1.Endpoint {
+		return discoveryv1.Endpoint{
+			Addresses:  []string{address},
+			Conditions: discoveryv1.EndpointConditions{Ready: ready},
+		}
+	}
+
+	cases := []struct {
+		name           string
+		objs           []client.Object
+		backend        gatewayapi.BackendObjectReference
+		want           []string
+		wantUnresolved bool
+	}{{
+		name:    "ClusterIP Service",
+		objs:    []client.Object{clusterIP},
+		backend: serviceRef(nil, "cluster-ip", ptr(int32(80))),
+		want:    []string{"10.96.0.10:80"},
+	}, {
+		name:    "Service with explicit namespace",
+		objs:    []client.Object{clusterIP},
+		backend: serviceRef(ptr("default"), "cluster-ip", ptr(int32(80))),
+		want:    []string{"10.96.0.10:80"},
+	}, {
+		name:    "ExternalName Service",
+		objs:    []client.Object{externalName},
+		backend: serviceRef(nil, "external", ptr(int32(443))),
+		want:    []string{"example.com:443"},
+	}, {
+		name: "headless Service",
+		objs: []client.Object{
+			headless,
+			headlessSlice("headless-a", endpoint("10.0.0.2", ptr(true)), endpoint("10.0.0.3", ptr(false))),
+			headlessSlice("headless-b", endpoint("10.0.0.1", nil)),
+		},
+		backend: serviceRef(nil, "headless", ptr(int32(80))),
+		want:    []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+	}, {
+		name: "headless Service without ready endpoints",
+		objs: []client.Object{
+			headless,
+			headlessSlice("headless-a", endpoint("10.0.0.1", ptr(false))),
+		},
+		backend: serviceRef(nil, "headless", ptr(int32(80))),
+	}, {
+		name:           "missing port",
+		objs:           []client.Object{clusterIP},
+		backend:        serviceRef(nil, "cluster-ip", nil),
+		wantUnresolved: true,
+	}, {
+		name:           "unknown port",
+		objs:           []client.Object{clusterIP},
+		backend:        serviceRef(nil, "cluster-ip", ptr(int32(81))),
+		wantUnresolved: true,
+	}, {
+		name:           "missing Service",
+		backend:        serviceRef(nil, "missing", ptr(int32(80))),
+		wantUnresolved: true,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrlr := testRouteController(t, tc.objs...)
+
+			got, err := ctrlr.resolveBackend(context.Background(), "default", tc.backend)
+			var unresolved unresolvedError
+			if tc.wantUnresolved {
+				if !errors.As(err, &unresolved) {
+					t.Fatalf("got error %v, want unresolvedError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
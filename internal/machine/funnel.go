@@ -0,0 +1,54 @@
+package machine
+
+import (
+	"fmt"
+	"strings"
+
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/ipn"
+
+	"github.com/michaelbeaumont/tailway/pkg"
+)
+
+// listenerConditionFunnel reports whether a listener that opted into Funnel
+// is reachable from the internet.
+const listenerConditionFunnel gatewayapi.ListenerConditionType = "tailway.michaelbeaumont.github.io/Funnel"
+
+const (
+	listenerReasonFunnelEnabled      gatewayapi.ListenerConditionReason = "Enabled"
+	listenerReasonFunnelNotPermitted gatewayapi.ListenerConditionReason = "NotPermitted"
+)
+
+// funnelPorts are the ports Funnel can expose.
+var funnelPorts = map[gatewayapi.PortNumber]bool{443: true, 8443: true, 10000: true}
+
+// wantsFunnel checks whether listener is listed in the Funnel annotation of
+// gateway.
+func wantsFunnel(gateway *gatewayapi.Gateway, listener gatewayapi.Listener) bool {
+	annotation, ok := gateway.Annotations[pkg.FunnelAnnotation]
+	if !ok {
+		return false
+	}
+	for _, name := range strings.Split(annotation, ",") {
+		name = strings.TrimSpace(name)
+		if name == "*" || name == string(listener.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// funnelProblem returns why listener can't be exposed with Funnel by a node
+// with capabilities, if it can't.
+func funnelProblem(listener gatewayapi.Listener, capabilities []string) (gatewayapi.ListenerConditionReason, string) {
+	if listener.Protocol == gatewayapi.HTTPProtocolType {
+		return gatewayapi.ListenerReasonInvalid, "Funnel requires TLS, use an HTTPS listener"
+	}
+	if !funnelPorts[listener.Port] {
+		return gatewayapi.ListenerReasonInvalid, fmt.Sprintf("Funnel only supports ports 443, 8443 and 10000, not %d", listener.Port)
+	}
+	if err := ipn.CheckFunnelAccess(uint16(listener.Port), capabilities); err != nil {
+		return listenerReasonFunnelNotPermitted, err.Error()
+	}
+	return "", ""
+}
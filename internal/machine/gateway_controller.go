@@ -2,33 +2,63 @@ package machine
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
 	"strings"
 
-	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	api_errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
 
 	"github.com/michaelbeaumont/tailway/pkg"
 )
 
 type GatewayController struct {
-	client.Client
-	Logger logr.Logger
-	TLC    *tailscale.LocalClient
+	routeController
+	TLC *tailscale.LocalClient
+}
+
+// enqueueServed maps every object to requests for the Gateways served by this
+// machine.
+func (ctrlr *GatewayController) enqueueServed() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, _ client.Object) []reconcile.Request {
+		gateways := gatewayapi.GatewayList{}
+		if err := ctrlr.List(ctx, &gateways); err != nil {
+			ctrlr.Logger.Error(err, "unexpected error listing Gateways")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for i := range gateways.Items {
+			if ctrlr.servedByMachine(&gateways.Items[i]) {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: client.ObjectKeyFromObject(&gateways.Items[i]),
+				})
+			}
+		}
+		return requests
+	})
 }
 
 func (ctrlr *GatewayController) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 	gateway := &gatewayapi.Gateway{}
 	err := ctrlr.Get(ctx, req.NamespacedName, gateway)
 	if err != nil {
-		return reconcile.Result{}, err
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !ctrlr.servedByMachine(gateway) {
+		return reconcile.Result{}, nil
 	}
 
 	ctrlr.Logger.Info("checking GatewayClass of parent Gateway", "name", gateway.Spec.GatewayClassName)
@@ -61,21 +91,58 @@ func (ctrlr *GatewayController) setStatus(
 		return errors.Wrap(err, "couldn't get tailscale status")
 	}
 
-	orig := gateway.DeepCopyObject().(client.Object)
+	serveConfig, err := ctrlr.TLC.GetServeConfig(ctx)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get serve config")
+	}
+	if serveConfig == nil {
+		serveConfig = &ipn.ServeConfig{}
+	}
+
+	setBackendState(machineStatus.BackendState)
+	tcpPortHandlers.Set(float64(len(serveConfig.TCP)))
+
+	orig := gateway.DeepCopy()
+
+	name := ctrlr.Name.Get()
+	var certErr error
+	if machineStatus.BackendState == ipn.Running.String() && needsCert(gateway) {
+		certPEM, _, err := ctrlr.TLC.CertPair(ctx, name)
+		if err != nil {
+			certErr = err
+		} else {
+			setCertExpiry(name, certPEM)
+		}
+	}
+
+	var capabilities []string
+	if machineStatus.Self != nil {
+		capabilities = machineStatus.Self.Capabilities
+	}
+
+	listenerStatuses, err := ctrlr.listenerStatuses(ctx, gateway, serveConfig, certErr, capabilities)
+	if err != nil {
+		return err
+	}
 
-	hostname := gatewayapi.HostnameAddressType
-	addrs := []gatewayapi.GatewayAddress{{
-		Type:  &hostname,
-		Value: strings.TrimSuffix(machineStatus.Self.DNSName, "."),
-	}}
-	ip := gatewayapi.IPAddressType
-	for _, addr := range machineStatus.Self.TailscaleIPs {
-		addrs = append(addrs, gatewayapi.GatewayAddress{
-			Type:  &ip,
-			Value: addr.String(),
-		})
+	// until the machine has joined the tailnet there are no addresses to
+	// report yet
+	if machineStatus.Self != nil && machineStatus.Self.DNSName != "" {
+		hostname := gatewayapi.HostnameAddressType
+		addrs := []gatewayapi.GatewayAddress{{
+			Type:  &hostname,
+			Value: strings.TrimSuffix(machineStatus.Self.DNSName, "."),
+		}}
+		ip := gatewayapi.IPAddressType
+		for _, addr := range machineStatus.Self.TailscaleIPs {
+			addrs = append(addrs, gatewayapi.GatewayAddress{
+				Type:  &ip,
+				Value: addr.String(),
+			})
+		}
+		gateway.Status.Addresses = addrs
 	}
-	gateway.Status.Addresses = addrs
+	gateway.Status.Listeners = listenerStatuses
 
 	meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
 		ObservedGeneration: gateway.GetGeneration(),
@@ -83,12 +150,241 @@ func (ctrlr *GatewayController) setStatus(
 		Status:             metav1.ConditionTrue,
 		Reason:             string(gatewayapi.GatewayReasonAccepted),
 	})
-	meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+
+	programmed := metav1.Condition{
 		ObservedGeneration: gateway.GetGeneration(),
 		Type:               string(gatewayapi.GatewayConditionProgrammed),
 		Status:             metav1.ConditionTrue,
-		Reason:             string(gatewayapi.GatewayConditionProgrammed),
-	})
+		Reason:             string(gatewayapi.GatewayReasonProgrammed),
+	}
+	switch {
+	case machineStatus.BackendState != ipn.Running.String():
+		programmed.Status = metav1.ConditionFalse
+		programmed.Reason = string(gatewayapi.GatewayReasonPending)
+		programmed.Message = backendStateMessage(machineStatus)
+	case certErr != nil:
+		programmed.Status = metav1.ConditionFalse
+		programmed.Reason = string(gatewayapi.GatewayReasonPending)
+		programmed.Message = fmt.Sprintf("couldn't get a certificate for %s: %s", name, certErr)
+	}
+	meta.SetStatusCondition(&gateway.Status.Conditions, programmed)
+
+	if reflect.DeepEqual(orig.Status, gateway.Status) {
+		return nil
+	}
+
+	// the tailnet controller patches the same conditions
+	return ctrlr.Status().Patch(ctx, gateway, client.MergeFromWithOptions(orig, client.MergeFromWithOptimisticLock{}))
+}
+
+// needsCert checks whether any listener of gateway terminates TLS, which
+// requires HTTPS certificates to be enabled for the tailnet.
+func needsCert(gateway *gatewayapi.Gateway) bool {
+	for _, listener := range gateway.Spec.Listeners {
+		if listener.Protocol == gatewayapi.TLSProtocolType || listener.Protocol == gatewayapi.HTTPSProtocolType {
+			return true
+		}
+	}
+	return false
+}
+
+// routeKinds returns the kinds of routes that can attach to listeners with
+// protocol.
+func routeKinds(protocol gatewayapi.ProtocolType) []gatewayapi.RouteGroupKind {
+	group := gatewayapi.Group(gatewayapi.GroupName)
+	switch protocol {
+	case gatewayapi.TCPProtocolType, gatewayapi.TLSProtocolType:
+		return []gatewayapi.RouteGroupKind{{Group: &group, Kind: "TCPRoute"}}
+	case gatewayapi.HTTPProtocolType, gatewayapi.HTTPSProtocolType:
+		return []gatewayapi.RouteGroupKind{{Group: &group, Kind: "HTTPRoute"}}
+	default:
+		return nil
+	}
+}
+
+// attachedRoutes counts the routes accepted for each listener of gateway.
+func (ctrlr *GatewayController) attachedRoutes(
+	ctx context.Context,
+	gateway *gatewayapi.Gateway,
+) (map[gatewayapi.SectionName]int32, error) {
+	attached := map[gatewayapi.SectionName]int32{}
+
+	owners, err := ctrlr.tcpListenerOwners(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, listener := range gateway.Spec.Listeners {
+		if _, ok := owners[listener.Port]; ok && hasProtocol(tcpRouteProtocols, listener.Protocol) {
+			attached[listener.Name] = 1
+		}
+	}
+
+	httpRoutes := gatewayapi.HTTPRouteList{}
+	if err := ctrlr.List(ctx, &httpRoutes); err != nil {
+		return nil, err
+	}
+	for i := range httpRoutes.Items {
+		route := &httpRoutes.Items[i]
+		attachments, err := ctrlr.attachments(ctx, route.Namespace, route.Spec.ParentRefs, httpRouteProtocols...)
+		if err != nil {
+			return nil, err
+		}
+		listeners := attachedListeners(attachments)
+		if len(listeners) == 0 {
+			continue
+		}
+		_, accepted, _, err := ctrlr.acceptHTTPRoute(ctx, route)
+		if err != nil {
+			return nil, err
+		}
+		if accepted.Status != metav1.ConditionTrue {
+			continue
+		}
+		for _, listener := range listeners {
+			attached[listener.name]++
+		}
+	}
+
+	return attached, nil
+}
+
+// listenerStatuses reports for each listener of gateway how many routes are
+// attached, whether tailscaled actually serves it and, if it opted into
+// Funnel, whether it's exposed to the internet.
+func (ctrlr *GatewayController) listenerStatuses(
+	ctx context.Context,
+	gateway *gatewayapi.Gateway,
+	serveConfig *ipn.ServeConfig,
+	certErr error,
+	capabilities []string,
+) ([]gatewayapi.ListenerStatus, error) {
+	attached, err := ctrlr.attachedRoutes(ctx, gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	portListeners := map[gatewayapi.PortNumber]int{}
+	for _, listener := range gateway.Spec.Listeners {
+		portListeners[listener.Port]++
+	}
+
+	var statuses []gatewayapi.ListenerStatus
+	for _, listener := range gateway.Spec.Listeners {
+		var existing []metav1.Condition
+		for _, status := range gateway.Status.Listeners {
+			if status.Name == listener.Name {
+				existing = append([]metav1.Condition{}, status.Conditions...)
+			}
+		}
+
+		status := gatewayapi.ListenerStatus{
+			Name:           listener.Name,
+			SupportedKinds: []gatewayapi.RouteGroupKind{},
+			AttachedRoutes: attached[listener.Name],
+			Conditions:     existing,
+		}
+
+		setCondition := func(
+			conditionType gatewayapi.ListenerConditionType,
+			conditionStatus metav1.ConditionStatus,
+			reason gatewayapi.ListenerConditionReason,
+			message string,
+		) {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				ObservedGeneration: gateway.GetGeneration(),
+				Type:               string(conditionType),
+				Status:             conditionStatus,
+				Reason:             string(reason),
+				Message:            message,
+			})
+		}
+
+		kinds := routeKinds(listener.Protocol)
+		if len(kinds) == 0 {
+			setCondition(gatewayapi.ListenerConditionAccepted, metav1.ConditionFalse, gatewayapi.ListenerReasonUnsupportedProtocol,
+				fmt.Sprintf("protocol %s is not supported", listener.Protocol))
+			setCondition(gatewayapi.ListenerConditionProgrammed, metav1.ConditionFalse, gatewayapi.ListenerReasonInvalid, "")
+			statuses = append(statuses, status)
+			continue
+		}
+		setCondition(gatewayapi.ListenerConditionAccepted, metav1.ConditionTrue, gatewayapi.ListenerReasonAccepted, "")
+
+		invalidKinds := false
+		if listener.AllowedRoutes != nil && len(listener.AllowedRoutes.Kinds) > 0 {
+			for _, kind := range listener.AllowedRoutes.Kinds {
+				if kind.Kind == kinds[0].Kind && (kind.Group == nil || *kind.Group == *kinds[0].Group) {
+					status.SupportedKinds = append(status.SupportedKinds, kinds[0])
+				} else {
+					invalidKinds = true
+				}
+			}
+		} else {
+			status.SupportedKinds = kinds
+		}
+		if invalidKinds {
+			setCondition(gatewayapi.ListenerConditionResolvedRefs, metav1.ConditionFalse, gatewayapi.ListenerReasonInvalidRouteKinds,
+				fmt.Sprintf("only %s can be attached to %s listeners", kinds[0].Kind, listener.Protocol))
+		} else {
+			setCondition(gatewayapi.ListenerConditionResolvedRefs, metav1.ConditionTrue, gatewayapi.ListenerReasonResolvedRefs, "")
+		}
+
+		if portListeners[listener.Port] > 1 {
+			setCondition(gatewayapi.ListenerConditionConflicted, metav1.ConditionTrue, gatewayapi.ListenerReasonProtocolConflict,
+				fmt.Sprintf("port %d is used by multiple listeners", listener.Port))
+		} else {
+			setCondition(gatewayapi.ListenerConditionConflicted, metav1.ConditionFalse, gatewayapi.ListenerReasonNoConflicts, "")
+		}
+
+		terminatesTLS := listener.Protocol == gatewayapi.TLSProtocolType || listener.Protocol == gatewayapi.HTTPSProtocolType
+		if served, message := servesListener(serveConfig, listener); !served {
+			setCondition(gatewayapi.ListenerConditionProgrammed, metav1.ConditionFalse, gatewayapi.ListenerReasonPending, message)
+		} else if terminatesTLS && certErr != nil {
+			setCondition(gatewayapi.ListenerConditionProgrammed, metav1.ConditionFalse, gatewayapi.ListenerReasonPending,
+				fmt.Sprintf("couldn't get a certificate: %s", certErr))
+		} else {
+			setCondition(gatewayapi.ListenerConditionProgrammed, metav1.ConditionTrue, gatewayapi.ListenerReasonProgrammed, "")
+		}
+
+		hostPort := ipn.HostPort(net.JoinHostPort(ctrlr.Name.Get(), strconv.Itoa(int(listener.Port))))
+		switch reason, message := funnelProblem(listener, capabilities); {
+		case !wantsFunnel(gateway, listener):
+			meta.RemoveStatusCondition(&status.Conditions, string(listenerConditionFunnel))
+		case reason != "":
+			setCondition(listenerConditionFunnel, metav1.ConditionFalse, reason, message)
+		case !serveConfig.AllowFunnel[hostPort]:
+			setCondition(listenerConditionFunnel, metav1.ConditionFalse, gatewayapi.ListenerReasonPending, "listener isn't served yet")
+		default:
+			setCondition(listenerConditionFunnel, metav1.ConditionTrue, listenerReasonFunnelEnabled, "")
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// servesListener checks whether serveConfig has a handler for the port of
+// listener that matches its protocol.
+func servesListener(serveConfig *ipn.ServeConfig, listener gatewayapi.Listener) (bool, string) {
+	handler, ok := serveConfig.TCP[uint16(listener.Port)]
+	if !ok {
+		return false, "no routes are served on this port"
+	}
+
+	var matches bool
+	switch listener.Protocol {
+	case gatewayapi.TCPProtocolType:
+		matches = handler.TCPForward != "" && handler.TerminateTLS == ""
+	case gatewayapi.TLSProtocolType:
+		matches = handler.TCPForward != "" && handler.TerminateTLS != ""
+	case gatewayapi.HTTPProtocolType:
+		matches = handler.HTTP
+	case gatewayapi.HTTPSProtocolType:
+		matches = handler.HTTPS
+	}
+	if !matches {
+		return false, "port is served with a different protocol"
+	}
 
-	return ctrlr.Status().Patch(ctx, gateway, client.MergeFrom(orig))
+	return true, ""
 }
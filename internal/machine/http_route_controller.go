@@ -0,0 +1,315 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+type HTTPRouteController struct {
+	routeController
+}
+
+var httpRouteProtocols = []gatewayapi.ProtocolType{gatewayapi.HTTPProtocolType, gatewayapi.HTTPSProtocolType}
+
+// unsupportedError describes parts of an HTTPRoute we can't serve.
+type unsupportedError string
+
+func (err unsupportedError) Error() string {
+	return string(err)
+}
+
+// enqueueAll maps every object to requests for all HTTPRoutes, since a change
+// to a Gateway can change the listeners they're attached to.
+func (ctrlr *HTTPRouteController) enqueueAll() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, _ client.Object) []reconcile.Request {
+		routes := gatewayapi.HTTPRouteList{}
+		if err := ctrlr.List(ctx, &routes); err != nil {
+			ctrlr.Logger.Error(err, "unexpected error listing HTTPRoutes")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for i := range routes.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKeyFromObject(&routes.Items[i]),
+			})
+		}
+		return requests
+	})
+}
+
+// enqueueForService maps Services to requests for the HTTPRoutes referring to
+// them.
+func (ctrlr *HTTPRouteController) enqueueForService() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
+		key, ok := serviceKey(obj)
+		if !ok {
+			return nil
+		}
+
+		routes := gatewayapi.HTTPRouteList{}
+		if err := ctrlr.List(
+			ctx, &routes, client.MatchingFields{backendServiceField: key},
+		); err != nil {
+			ctrlr.Logger.Error(err, "unexpected error listing HTTPRoutes")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for i := range routes.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKeyFromObject(&routes.Items[i]),
+			})
+		}
+		return requests
+	})
+}
+
+func (ctrlr *HTTPRouteController) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	route := &gatewayapi.HTTPRoute{}
+	err := ctrlr.Get(ctx, req.NamespacedName, route)
+	if err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+
+	attachments, err := ctrlr.attachments(ctx, route.Namespace, route.Spec.ParentRefs, httpRouteProtocols...)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	ctrlr.Logger.Info("reconciling", "HTTPRoute", req.NamespacedName, "portProtocols", attachedListeners(attachments))
+
+	_, accepted, resolvedRefs, err := ctrlr.acceptHTTPRoute(ctx, route)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := ctrlr.setStatus(ctx, route, attachments, accepted, resolvedRefs); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// acceptHTTPRoute returns the router rules of route by mount point along with
+// the Accepted and ResolvedRefs conditions for it. No rules are returned if it
+// isn't accepted.
+func (ctrlr *routeController) acceptHTTPRoute(
+	ctx context.Context,
+	route *gatewayapi.HTTPRoute,
+) (map[string][]httpRouterRule, metav1.Condition, metav1.Condition, error) {
+	accepted := metav1.Condition{
+		ObservedGeneration: route.GetGeneration(),
+		Type:               string(gatewayapi.RouteConditionAccepted),
+		Status:             metav1.ConditionTrue,
+		Reason:             string(gatewayapi.RouteReasonAccepted),
+	}
+
+	var unsupported unsupportedError
+	mounts, resolvedRefs, err := ctrlr.routerRules(ctx, route)
+	switch {
+	case errors.As(err, &unsupported):
+		accepted.Status = metav1.ConditionFalse
+		accepted.Reason = string(gatewayapi.RouteReasonUnsupportedValue)
+		accepted.Message = err.Error()
+		return nil, accepted, resolvedRefs, nil
+	case err != nil:
+		return nil, accepted, resolvedRefs, err
+	case !ctrlr.matchesHostnames(route.Spec.Hostnames):
+		accepted.Status = metav1.ConditionFalse
+		accepted.Reason = string(gatewayapi.RouteReasonNoMatchingListenerHostname)
+		accepted.Message = fmt.Sprintf("none of the hostnames match %s", ctrlr.Name.Get())
+		return nil, accepted, resolvedRefs, nil
+	}
+
+	return mounts, accepted, resolvedRefs, nil
+}
+
+// matchesHostnames checks whether this machine's name is one of hostnames, if
+// any are given.
+func (ctrlr *routeController) matchesHostnames(hostnames []gatewayapi.Hostname) bool {
+	if len(hostnames) == 0 {
+		return true
+	}
+	name := ctrlr.Name.Get()
+	for _, hostname := range hostnames {
+		if suffix, wildcard := strings.CutPrefix(string(hostname), "*"); wildcard {
+			if strings.HasSuffix(name, suffix) {
+				return true
+			}
+		} else if string(hostname) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// routerRules converts the rules of route to router rules by mount point and
+// returns the ResolvedRefs condition for its backends.
+func (ctrlr *routeController) routerRules(
+	ctx context.Context,
+	route *gatewayapi.HTTPRoute,
+) (map[string][]httpRouterRule, metav1.Condition, error) {
+	mounts := map[string][]httpRouterRule{}
+	var notPermitted, unresolved []string
+	resolvedRefs := func() metav1.Condition {
+		return resolvedRefsCondition(route.GetGeneration(), notPermitted, unresolved)
+	}
+
+	for i, rule := range route.Spec.Rules {
+		if len(rule.Filters) > 0 {
+			return nil, resolvedRefs(), unsupportedError(fmt.Sprintf("rule %d: filters are not supported", i))
+		}
+
+		var backends []weightedBackend
+		for _, backendRef := range rule.BackendRefs {
+			if len(backendRef.Filters) > 0 {
+				return nil, resolvedRefs(), unsupportedError(fmt.Sprintf("rule %d: backendRef filters are not supported", i))
+			}
+			if !isServiceRef(backendRef.BackendObjectReference) {
+				return nil, resolvedRefs(), unsupportedError(fmt.Sprintf("rule %d: only Service backendRefs are supported", i))
+			}
+
+			permitted, err := ctrlr.backendPermitted(ctx, "HTTPRoute", route.Namespace, backendRef.BackendObjectReference)
+			if err != nil {
+				return nil, resolvedRefs(), err
+			}
+			if !permitted {
+				notPermitted = append(notPermitted, fmt.Sprintf("%s/%s", *backendRef.Namespace, backendRef.Name))
+				continue
+			}
+
+			addresses, err := ctrlr.resolveBackend(ctx, route.Namespace, backendRef.BackendObjectReference)
+			var unresolvedErr unresolvedError
+			if errors.As(err, &unresolvedErr) {
+				unresolved = append(unresolved, err.Error())
+				continue
+			}
+			if err != nil {
+				return nil, resolvedRefs(), err
+			}
+
+			var weight int32 = 1
+			if backendRef.Weight != nil {
+				weight = *backendRef.Weight
+			}
+			backends = append(backends, weightedBackend{addresses: addresses, weight: weight})
+		}
+
+		if len(backends) == 0 {
+			continue
+		}
+
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []gatewayapi.HTTPRouteMatch{{}}
+		}
+
+		for _, match := range matches {
+			routerRule, mount, err := convertMatch(match)
+			if err != nil {
+				return nil, resolvedRefs(), errors.Wrapf(err, "rule %d", i)
+			}
+			routerRule.route = client.ObjectKeyFromObject(route)
+			routerRule.created = route.CreationTimestamp
+			routerRule.index = i
+			routerRule.mount = mount
+			routerRule.backends = backends
+
+			mounts[mount] = append(mounts[mount], routerRule)
+		}
+	}
+
+	return mounts, resolvedRefs(), nil
+}
+
+// convertMatch returns the router rule and mount point for match, without
+// any backends.
+func convertMatch(match gatewayapi.HTTPRouteMatch) (httpRouterRule, string, error) {
+	rule := httpRouterRule{}
+
+	mount := "/"
+	if match.Path != nil {
+		if match.Path.Value != nil {
+			mount = *match.Path.Value
+		}
+		if match.Path.Type != nil {
+			switch *match.Path.Type {
+			case gatewayapi.PathMatchPathPrefix:
+			case gatewayapi.PathMatchExact:
+				rule.exactPath = mount
+			default:
+				return rule, "", unsupportedError(fmt.Sprintf("path match type %s is not supported", *match.Path.Type))
+			}
+		}
+	}
+
+	if match.Method != nil {
+		rule.method = string(*match.Method)
+	}
+
+	for _, header := range match.Headers {
+		valueMatch, err := convertValueMatch(string(header.Name), header.Value, (*string)(header.Type))
+		if err != nil {
+			return rule, "", err
+		}
+		rule.headers = append(rule.headers, valueMatch)
+	}
+
+	for _, param := range match.QueryParams {
+		valueMatch, err := convertValueMatch(string(param.Name), param.Value, (*string)(param.Type))
+		if err != nil {
+			return rule, "", err
+		}
+		rule.queryParams = append(rule.queryParams, valueMatch)
+	}
+
+	return rule, mount, nil
+}
+
+func convertValueMatch(name, value string, matchType *string) (httpRouterValueMatch, error) {
+	valueMatch := httpRouterValueMatch{name: name, value: value}
+	if matchType != nil && *matchType == string(gatewayapi.HeaderMatchRegularExpression) {
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return valueMatch, unsupportedError(fmt.Sprintf("invalid regular expression for %s: %s", name, err))
+		}
+		valueMatch.regex = regex
+	}
+	return valueMatch, nil
+}
+
+func (ctrlr *HTTPRouteController) setStatus(
+	ctx context.Context,
+	route *gatewayapi.HTTPRoute,
+	attachments []parentAttachment,
+	accepted metav1.Condition,
+	resolvedRefs metav1.Condition,
+) error {
+	orig := route.DeepCopy()
+
+	pruneParentStatuses(&route.Status.RouteStatus, route.Spec.ParentRefs)
+	for _, attachment := range attachments {
+		if len(attachment.listeners) == 0 {
+			ctrlr.setParentStatus(&route.Status.RouteStatus, attachment.ref, notAttached(route.GetGeneration(), attachment))
+			continue
+		}
+		ctrlr.setParentStatus(&route.Status.RouteStatus, attachment.ref, accepted, resolvedRefs)
+	}
+
+	if reflect.DeepEqual(orig.Status, route.Status) {
+		return nil
+	}
+
+	return ctrlr.Status().Patch(ctx, route, client.MergeFrom(orig))
+}
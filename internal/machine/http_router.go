@@ -0,0 +1,277 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"tailscale.com/ipn"
+)
+
+// httpRouterAddr is where the router listens inside the machine pod, which
+// shares its network namespace with tailscaled.
+const httpRouterAddr = "127.0.0.1:8088"
+
+// httpRouter handles the HTTPRoute rules that tailscaled's serve config can't
+// express on its own: header, method, query and exact path matches as well as
+// multiple backends. tailscaled proxies such a mount point to the router under
+// a prefix identifying the host:port and mount point.
+type httpRouter struct {
+	Logger logr.Logger
+
+	sync.RWMutex
+	// mounts maps from mount point to the rules for that mount
+	mounts map[routerMount][]httpRouterRule
+	// keys maps from the key in the request path to the mount point
+	keys map[string]routerMount
+
+	proxy *httputil.ReverseProxy
+}
+
+type routerMount struct {
+	hostPort ipn.HostPort
+	mount    string
+}
+
+// key identifies the mount point in the router's request paths.
+func (m routerMount) key() string {
+	h := fnv.New64a()
+	h.Write([]byte(m.hostPort))
+	h.Write([]byte{0})
+	h.Write([]byte(m.mount))
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// proxyTarget returns the HTTPHandler.Proxy value that sends the mount point
+// to the router.
+func (m routerMount) proxyTarget() string {
+	return "http://" + httpRouterAddr + "/" + m.key() + strings.TrimSuffix(m.mount, "/")
+}
+
+// covers checks whether requests for other would also be matched by a path
+// prefix of m.
+func (m routerMount) covers(other routerMount) bool {
+	if m.hostPort != other.hostPort {
+		return false
+	}
+	prefix := strings.TrimSuffix(m.mount, "/")
+	return other.mount == m.mount || prefix == "" || strings.HasPrefix(other.mount, prefix+"/")
+}
+
+type httpRouterRule struct {
+	route   types.NamespacedName
+	created metav1.Time
+	index   int
+	mount   string
+
+	exactPath   string
+	method      string
+	headers     []httpRouterValueMatch
+	queryParams []httpRouterValueMatch
+	backends    []weightedBackend
+}
+
+type httpRouterValueMatch struct {
+	name  string
+	value string
+	regex *regexp.Regexp
+}
+
+type backendContextKey struct{}
+
+func newHTTPRouter(logger logr.Logger) *httpRouter {
+	router := &httpRouter{
+		Logger: logger,
+		mounts: map[routerMount][]httpRouterRule{},
+		keys:   map[string]routerMount{},
+	}
+	router.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Context().Value(backendContextKey{}).(string)
+			r.Out.Host = r.In.Host
+			// tailscaled already set these, keep them instead of
+			// pretending we're the client
+			for _, header := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+				if value := r.In.Header.Get(header); value != "" {
+					r.Out.Header.Set(header, value)
+				}
+			}
+		},
+	}
+	return router
+}
+
+// Replace sets the rules the router serves.
+func (router *httpRouter) Replace(mounts map[routerMount][]httpRouterRule) {
+	keys := map[string]routerMount{}
+	for mount := range mounts {
+		keys[mount.key()] = mount
+	}
+
+	router.Lock()
+	defer router.Unlock()
+
+	router.mounts = mounts
+	router.keys = keys
+}
+
+// rules returns the rules for a mount point in order of precedence,
+// including those of shorter prefixes that tailscaled won't fall back to.
+func (router *httpRouter) rules(mount routerMount) []httpRouterRule {
+	router.RLock()
+	defer router.RUnlock()
+
+	var rules []httpRouterRule
+	for other, otherRules := range router.mounts {
+		if other.covers(mount) {
+			rules = append(rules, otherRules...)
+		}
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		switch {
+		case len(a.mount) != len(b.mount):
+			return len(a.mount) > len(b.mount)
+		case (a.exactPath != "") != (b.exactPath != ""):
+			return a.exactPath != ""
+		case (a.method != "") != (b.method != ""):
+			return a.method != ""
+		case len(a.headers) != len(b.headers):
+			return len(a.headers) > len(b.headers)
+		case len(a.queryParams) != len(b.queryParams):
+			return len(a.queryParams) > len(b.queryParams)
+		case !a.created.Equal(&b.created):
+			return a.created.Before(&b.created)
+		case a.route != b.route:
+			return a.route.String() < b.route.String()
+		default:
+			return a.index < b.index
+		}
+	})
+
+	return rules
+}
+
+// Direct returns the backend a mount point can be proxied to by tailscaled
+// without going through the router, if any.
+func (router *httpRouter) Direct(mount routerMount) (string, bool) {
+	router.RLock()
+	rules := router.mounts[mount]
+	router.RUnlock()
+
+	if len(rules) != 1 {
+		return "", false
+	}
+	rule := rules[0]
+	if rule.exactPath != "" || rule.method != "" || len(rule.headers) > 0 || len(rule.queryParams) > 0 {
+		return "", false
+	}
+	// backends with weight 0 don't get any requests
+	var backends []weightedBackend
+	for _, backend := range rule.backends {
+		if backend.weight > 0 && len(backend.addresses) > 0 {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) != 1 || len(backends[0].addresses) != 1 {
+		return "", false
+	}
+	return backends[0].addresses[0], true
+}
+
+func (rule *httpRouterRule) matches(r *http.Request, path string) bool {
+	if rule.exactPath != "" && strings.TrimSuffix(path, "/") != strings.TrimSuffix(rule.exactPath, "/") {
+		return false
+	}
+	if rule.method != "" && r.Method != rule.method {
+		return false
+	}
+	for _, header := range rule.headers {
+		if !header.matches(r.Header.Values(header.name)) {
+			return false
+		}
+	}
+	query := r.URL.Query()
+	for _, param := range rule.queryParams {
+		if !param.matches(query[param.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (match *httpRouterValueMatch) matches(values []string) bool {
+	for _, value := range values {
+		if match.regex != nil && match.regex.MatchString(value) ||
+			match.regex == nil && value == match.value {
+			return true
+		}
+	}
+	return false
+}
+
+func (router *httpRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	path = "/" + path
+
+	router.RLock()
+	mount, ok := router.keys[key]
+	router.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, rule := range router.rules(mount) {
+		if !rule.matches(r, path) {
+			continue
+		}
+		backend, ok := pickBackend(rule.backends)
+		if !ok {
+			http.Error(w, "no backend available", http.StatusInternalServerError)
+			return
+		}
+		r.URL.Path = path
+		r.URL.RawPath = ""
+		router.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendContextKey{}, backend)))
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// Start serves the router until ctx is done.
+func (router *httpRouter) Start(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              httpRouterAddr,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			router.Logger.Error(err, "couldn't shut down HTTP router")
+		}
+	}()
+
+	router.Logger.Info("starting HTTP router", "address", httpRouterAddr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
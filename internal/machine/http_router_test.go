@@ -0,0 +1,291 @@
+package machine
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const testHostPort = "machine.example.ts.net:443"
+
+// roundTripFunc answers the requests of the router's proxy in place of
+// the backends.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// testRouter returns a router serving rules whose backends answer with their
+// address.
+func testRouter(rules []httpRouterRule) *httpRouter {
+	router := newHTTPRouter(logr.Discard())
+	router.proxy.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(r.URL.Host)),
+			Request:    r,
+		}, nil
+	})
+
+	mounts := map[routerMount][]httpRouterRule{}
+	for _, rule := range rules {
+		mount := routerMount{hostPort: testHostPort, mount: rule.mount}
+		mounts[mount] = append(mounts[mount], rule)
+	}
+	router.Replace(mounts)
+	return router
+}
+
+func backends(addresses ...string) []weightedBackend {
+	var backends []weightedBackend
+	for _, address := range addresses {
+		backends = append(backends, weightedBackend{addresses: []string{address}, weight: 1})
+	}
+	return backends
+}
+
+func TestHTTPRouterPrecedence(t *testing.T) {
+	older := metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(older.Add(time.Hour))
+	routeA := types.NamespacedName{Namespace: "default", Name: "a"}
+	routeB := types.NamespacedName{Namespace: "default", Name: "b"}
+
+	type request struct {
+		// mount is the mount point tailscaled sends the request to
+		mount   string
+		method  string
+		path    string
+		headers map[string]string
+	}
+
+	cases := []struct {
+		name       string
+		rules      []httpRouterRule
+		request    request
+		wantStatus int
+		wantBody   string
+	}{{
+		name: "exact path before prefix",
+		rules: []httpRouterRule{
+			{mount: "/api", backends: backends("prefix:80")},
+			{mount: "/api/v1", exactPath: "/api/v1", backends: backends("exact:80")},
+		},
+		request:  request{mount: "/api/v1", path: "/api/v1"},
+		wantBody: "exact:80",
+	}, {
+		name: "shorter prefix when exact path doesn't match",
+		rules: []httpRouterRule{
+			{mount: "/api", backends: backends("prefix:80")},
+			{mount: "/api/v1", exactPath: "/api/v1", backends: backends("exact:80")},
+		},
+		request:  request{mount: "/api/v1", path: "/api/v1/users"},
+		wantBody: "prefix:80",
+	}, {
+		name: "longer prefix first",
+		rules: []httpRouterRule{
+			{mount: "/", backends: backends("root:80")},
+			{mount: "/api", backends: backends("api:80")},
+		},
+		request:  request{mount: "/api", path: "/api/users"},
+		wantBody: "api:80",
+	}, {
+		name: "method before no method",
+		rules: []httpRouterRule{
+			{mount: "/", backends: backends("any:80")},
+			{mount: "/", method: http.MethodPost, backends: backends("post:80")},
+		},
+		request:  request{mount: "/", method: http.MethodPost, path: "/"},
+		wantBody: "post:80",
+	}, {
+		name: "other method falls through",
+		rules: []httpRouterRule{
+			{mount: "/", backends: backends("any:80")},
+			{mount: "/", method: http.MethodPost, backends: backends("post:80")},
+		},
+		request:  request{mount: "/", method: http.MethodGet, path: "/"},
+		wantBody: "any:80",
+	}, {
+		name: "more headers first",
+		rules: []httpRouterRule{
+			{mount: "/", headers: []httpRouterValueMatch{{name: "X-Version", value: "v2"}}, backends: backends("v2:80")},
+			{mount: "/", headers: []httpRouterValueMatch{
+				{name: "X-Version", value: "v2"},
+				{name: "X-Canary", regex: regexp.MustCompile("^(yes|true)$")},
+			}, backends: backends("canary:80")},
+		},
+		request:  request{mount: "/", path: "/", headers: map[string]string{"X-Version": "v2", "X-Canary": "true"}},
+		wantBody: "canary:80",
+	}, {
+		name: "headers before query params",
+		rules: []httpRouterRule{
+			{mount: "/", queryParams: []httpRouterValueMatch{{name: "version", value: "v2"}}, backends: backends("query:80")},
+			{mount: "/", headers: []httpRouterValueMatch{{name: "X-Version", value: "v2"}}, backends: backends("header:80")},
+		},
+		request:  request{mount: "/", path: "/?version=v2", headers: map[string]string{"X-Version": "v2"}},
+		wantBody: "header:80",
+	}, {
+		name: "query params",
+		rules: []httpRouterRule{
+			{mount: "/", backends: backends("any:80")},
+			{mount: "/", queryParams: []httpRouterValueMatch{{name: "version", value: "v2"}}, backends: backends("query:80")},
+		},
+		request:  request{mount: "/", path: "/?version=v2"},
+		wantBody: "query:80",
+	}, {
+		name: "older route first",
+		rules: []httpRouterRule{
+			{mount: "/", route: routeA, created: newer, backends: backends("newer:80")},
+			{mount: "/", route: routeB, created: older, backends: backends("older:80")},
+		},
+		request:  request{mount: "/", path: "/"},
+		wantBody: "older:80",
+	}, {
+		name: "route name breaks ties",
+		rules: []httpRouterRule{
+			{mount: "/", route: routeB, created: older, backends: backends("b:80")},
+			{mount: "/", route: routeA, created: older, backends: backends("a:80")},
+		},
+		request:  request{mount: "/", path: "/"},
+		wantBody: "a:80",
+	}, {
+		name: "earlier rule of a route first",
+		rules: []httpRouterRule{
+			{mount: "/", route: routeA, index: 1, backends: backends("second:80")},
+			{mount: "/", route: routeA, index: 0, backends: backends("first:80")},
+		},
+		request:  request{mount: "/", path: "/"},
+		wantBody: "first:80",
+	}, {
+		name: "no match",
+		rules: []httpRouterRule{
+			{mount: "/", headers: []httpRouterValueMatch{{name: "X-Version", value: "v2"}}, backends: backends("v2:80")},
+		},
+		request:    request{mount: "/", path: "/"},
+		wantStatus: http.StatusNotFound,
+	}, {
+		name: "only backends with weight 0",
+		rules: []httpRouterRule{
+			{mount: "/", backends: []weightedBackend{{addresses: []string{"zero:80"}, weight: 0}}},
+		},
+		request:    request{mount: "/", path: "/"},
+		wantStatus: http.StatusInternalServerError,
+	}, {
+		name: "backends with weight 0 are skipped",
+		rules: []httpRouterRule{
+			{mount: "/", backends: []weightedBackend{
+				{addresses: []string{"zero:80"}, weight: 0},
+				{addresses: []string{"one:80"}, weight: 1},
+			}},
+		},
+		request:  request{mount: "/", path: "/"},
+		wantBody: "one:80",
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := testRouter(tc.rules)
+
+			method := tc.request.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			mount := routerMount{hostPort: testHostPort, mount: tc.request.mount}
+			r := httptest.NewRequest(method, "/"+mount.key()+tc.request.path, nil)
+			for name, value := range tc.request.headers {
+				r.Header.Set(name, value)
+			}
+
+			// weights are random, try a few times
+			for i := 0; i < 10; i++ {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r.Clone(r.Context()))
+
+				wantStatus := tc.wantStatus
+				if wantStatus == 0 {
+					wantStatus = http.StatusOK
+				}
+				if w.Code != wantStatus {
+					t.Fatalf("got status %d, want %d", w.Code, wantStatus)
+				}
+				if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+					t.Fatalf("got backend %q, want %q", w.Body.String(), tc.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPRouterDirect(t *testing.T) {
+	cases := []struct {
+		name   string
+		rules  []httpRouterRule
+		want   string
+		wantOk bool
+	}{{
+		name:   "single backend",
+		rules:  []httpRouterRule{{mount: "/", backends: backends("a:80")}},
+		want:   "a:80",
+		wantOk: true,
+	}, {
+		name:  "multiple backends",
+		rules: []httpRouterRule{{mount: "/", backends: backends("a:80", "b:80")}},
+	}, {
+		name: "multiple addresses",
+		rules: []httpRouterRule{{mount: "/", backends: []weightedBackend{
+			{addresses: []string{"10.0.0.1:80", "10.0.0.2:80"}, weight: 1},
+		}}},
+	}, {
+		name: "other backend has weight 0",
+		rules: []httpRouterRule{{mount: "/", backends: []weightedBackend{
+			{addresses: []string{"zero:80"}, weight: 0},
+			{addresses: []string{"one:80"}, weight: 1},
+		}}},
+		want:   "one:80",
+		wantOk: true,
+	}, {
+		name: "only backend has weight 0",
+		rules: []httpRouterRule{{mount: "/", backends: []weightedBackend{
+			{addresses: []string{"zero:80"}, weight: 0},
+		}}},
+	}, {
+		name: "other backend has no addresses",
+		rules: []httpRouterRule{{mount: "/", backends: []weightedBackend{
+			{weight: 1},
+			{addresses: []string{"one:80"}, weight: 1},
+		}}},
+		want:   "one:80",
+		wantOk: true,
+	}, {
+		name:  "exact path",
+		rules: []httpRouterRule{{mount: "/", exactPath: "/", backends: backends("a:80")}},
+	}, {
+		name:  "method",
+		rules: []httpRouterRule{{mount: "/", method: http.MethodGet, backends: backends("a:80")}},
+	}, {
+		name: "multiple rules",
+		rules: []httpRouterRule{
+			{mount: "/", backends: backends("a:80")},
+			{mount: "/", index: 1, backends: backends("b:80")},
+		},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := testRouter(tc.rules)
+
+			got, ok := router.Direct(routerMount{hostPort: testHostPort, mount: "/"})
+			if got != tc.want || ok != tc.wantOk {
+				t.Errorf("got (%q, %t), want (%q, %t)", got, ok, tc.want, tc.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package machine
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+// ipnWatcher watches the IPN bus of tailscaled and notifies controllers
+// whenever the state, DNS name, addresses or capabilities of the node
+// change, which all end up in the Gateway status.
+type ipnWatcher struct {
+	Logger logr.Logger
+	TLC    *tailscale.LocalClient
+	// Name is updated whenever the DNS name of the node changes
+	Name *machineName
+	// State is updated whenever the backend state changes
+	State  *tailscaleState
+	notify []chan<- event.GenericEvent
+}
+
+// machineName is the DNS name of the machine, which changes if the device is
+// renamed or the tailnet's DNS name changes. It's shared by the controllers,
+// which read it on every reconcile.
+type machineName struct {
+	name atomic.Pointer[string]
+}
+
+func (name *machineName) Get() string {
+	if current := name.name.Load(); current != nil {
+		return *current
+	}
+	return ""
+}
+
+func (name *machineName) Set(current string) {
+	name.name.Store(&current)
+}
+
+// nodeState is what we track of the node.
+type nodeState struct {
+	backendState string
+	name         string
+	addresses    []netip.Prefix
+	capabilities []string
+}
+
+// Start watches until ctx is done, reconnecting with backoff.
+func (watcher *ipnWatcher) Start(ctx context.Context) error {
+	backoff := minStartupBackoff
+	for {
+		received, err := watcher.watch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if received {
+			backoff = minStartupBackoff
+		}
+		watcher.Logger.Error(err, "couldn't watch IPN bus, retrying", "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// watch notifies about changes until the bus fails and reports whether it
+// received anything before.
+func (watcher *ipnWatcher) watch(ctx context.Context) (bool, error) {
+	bus, err := watcher.TLC.WatchIPNBus(ctx, ipn.NotifyInitialState|ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys)
+	if err != nil {
+		return false, err
+	}
+	defer bus.Close()
+
+	received := false
+	last := nodeState{}
+	for {
+		notification, err := bus.Next()
+		if err != nil {
+			return received, err
+		}
+		received = true
+
+		current := last
+		if notification.State != nil {
+			current.backendState = notification.State.String()
+			setBackendState(current.backendState)
+			watcher.State.Set(current.backendState)
+		}
+		if netMap := notification.NetMap; netMap != nil {
+			current.name = netMap.Name
+			current.addresses = netMap.Addresses
+			current.capabilities = nil
+			if netMap.SelfNode != nil {
+				current.capabilities = netMap.SelfNode.Capabilities
+			}
+		}
+		if reflect.DeepEqual(current, last) {
+			continue
+		}
+		last = current
+
+		if name := strings.TrimSuffix(current.name, "."); name != "" && name != watcher.Name.Get() {
+			watcher.Logger.Info("DNS name of the machine changed", "name", name, "previous", watcher.Name.Get())
+			certExpiry.DeleteLabelValues(watcher.Name.Get())
+			watcher.Name.Set(name)
+		}
+
+		watcher.Logger.V(1).Info("node changed", "state", current.backendState, "name", current.name, "addresses", current.addresses)
+		for _, notify := range watcher.notify {
+			select {
+			case notify <- event.GenericEvent{Object: &gatewayapi.Gateway{}}:
+			default:
+				// a notification is already pending
+			}
+		}
+	}
+}
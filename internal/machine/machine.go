@@ -2,61 +2,201 @@ package machine
 
 import (
 	"context"
-	"strings"
-	"time"
+	"os"
 
 	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	gatewayapi_alpha "sigs.k8s.io/gateway-api/apis/v1alpha2"
 	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
 	"tailscale.com/client/tailscale"
-	"tailscale.com/ipn/ipnstate"
+
+	"github.com/michaelbeaumont/tailway/pkg"
 )
 
 func FromBuilder(
 	logger logr.Logger,
 	mgr manager.Manager,
+	socket string,
 ) error {
-	var tlc tailscale.LocalClient
-
-	var status *ipnstate.Status
-	for {
-		var err error
-		status, err = tlc.Status(context.Background())
-		if err != nil {
-			logger.Error(err, "could not get status")
-		}
-		if status.BackendState == "Running" {
-			break
+	gateway := types.NamespacedName{
+		Namespace: os.Getenv(pkg.GatewayNamespaceEnv),
+		Name:      os.Getenv(pkg.GatewayNameEnv),
+	}
+	if gateway.Namespace == "" || gateway.Name == "" {
+		return errors.Errorf("%s and %s must be set", pkg.GatewayNamespaceEnv, pkg.GatewayNameEnv)
+	}
+
+	if err := registerMetrics(); err != nil {
+		return err
+	}
+
+	tlc := tailscale.LocalClient{Socket: socket}
+
+	logger = logger.WithName("machine").WithValues("gateway", gateway)
+
+	for _, route := range []client.Object{&gatewayapi_alpha.TCPRoute{}, &gatewayapi.HTTPRoute{}} {
+		if err := mgr.GetFieldIndexer().IndexField(
+			context.Background(), route, backendServiceField, backendServiceIndexer,
+		); err != nil {
+			return err
 		}
-		time.Sleep(1 * time.Second)
 	}
 
-	name := strings.TrimSuffix(status.Self.DNSName, ".")
+	// the controllers need the DNS name of the machine, so they're only set
+	// up once tailscale is running, afterwards the ipnWatcher keeps it up to
+	// date
+	name := &machineName{}
+	state := &tailscaleState{}
+	waiter := &nodeWaiter{
+		Client:  mgr.GetClient(),
+		Logger:  logger.WithName("startup"),
+		TLC:     &tlc,
+		Gateway: gateway,
+		State:   state,
+	}
+	waiter.Setup = func(initial string) error {
+		name.Set(initial)
+		return setupControllers(logger, mgr, &tlc, gateway, name, state)
+	}
+	if err := mgr.Add(waiter); err != nil {
+		return err
+	}
+	return mgr.AddReadyzCheck("tailscale", state.ReadyCheck)
+}
 
-	logger = logger.WithName("machine").WithValues("name", name)
+// setupControllers sets up the controllers of the machine with name, keeping
+// name and state up to date.
+func setupControllers(
+	logger logr.Logger,
+	mgr manager.Manager,
+	tlc *tailscale.LocalClient,
+	gateway types.NamespacedName,
+	name *machineName,
+	state *tailscaleState,
+) error {
+	// changes of the node from the IPN bus affect the Gateway status,
+	// whether Funnel is allowed and, with the DNS name, what's served and
+	// which HTTPRoutes match
+	nodeChangedGateway := make(chan event.GenericEvent, 1)
+	nodeChangedServe := make(chan event.GenericEvent, 1)
+	nodeChangedHTTPRoute := make(chan event.GenericEvent, 1)
+	if err := mgr.Add(&ipnWatcher{
+		Logger: logger.WithName("ipnWatcher"),
+		TLC:    tlc,
+		Name:   name,
+		State:  state,
+		notify: []chan<- event.GenericEvent{nodeChangedGateway, nodeChangedServe, nodeChangedHTTPRoute},
+	}); err != nil {
+		return err
+	}
 
+	tcpRouteController := &TCPRouteController{
+		routeController: routeController{
+			Client:  mgr.GetClient(),
+			Logger:  logger.WithValues("resource", "TCPRoute"),
+			Name:    name,
+			Gateway: gateway,
+		},
+	}
 	if err := builder.
 		ControllerManagedBy(mgr).
 		For(&gatewayapi_alpha.TCPRoute{}).
-		Complete(&TCPRouteController{
-			Client: mgr.GetClient(),
-			TLC:    &tlc,
-			Logger: logger.WithValues("resource", "TCPRoute"),
-			Name:   name,
-		}); err != nil {
+		Watches(&gatewayapi_alpha.TCPRoute{}, tcpRouteController.enqueueAll()).
+		Watches(&gatewayapi.Gateway{}, tcpRouteController.enqueueAll()).
+		Watches(&v1.Service{}, tcpRouteController.enqueueForService()).
+		Watches(&gatewayapi.ReferenceGrant{}, tcpRouteController.enqueueAll()).
+		Watches(&v1.Namespace{}, tcpRouteController.enqueueAll()).
+		Complete(tcpRouteController); err != nil {
 		return err
 	}
 
+	httpRouteController := &HTTPRouteController{
+		routeController: routeController{
+			Client:  mgr.GetClient(),
+			Logger:  logger.WithValues("resource", "HTTPRoute"),
+			Name:    name,
+			Gateway: gateway,
+		},
+	}
+	if err := builder.
+		ControllerManagedBy(mgr).
+		For(&gatewayapi.HTTPRoute{}).
+		Watches(&gatewayapi.Gateway{}, httpRouteController.enqueueAll()).
+		Watches(&v1.Service{}, httpRouteController.enqueueForService()).
+		Watches(&gatewayapi.ReferenceGrant{}, httpRouteController.enqueueAll()).
+		Watches(&v1.Namespace{}, httpRouteController.enqueueAll()).
+		WatchesRawSource(&source.Channel{Source: nodeChangedHTTPRoute}, httpRouteController.enqueueAll()).
+		Complete(httpRouteController); err != nil {
+		return err
+	}
+
+	router := newHTTPRouter(logger.WithName("router"))
+	if err := mgr.Add(router); err != nil {
+		return err
+	}
+
+	tcpProxy := newTCPProxy(logger.WithName("proxy"))
+	if err := mgr.Add(tcpProxy); err != nil {
+		return err
+	}
+
+	// the ServeController notifies the GatewayController whenever it
+	// changed what's served, so that listener statuses are up to date
+	served := make(chan event.GenericEvent, 1)
+
+	serveController := &ServeController{
+		routeController: routeController{
+			Client:  mgr.GetClient(),
+			Logger:  logger.WithValues("resource", "ServeConfig"),
+			Name:    name,
+			Gateway: gateway,
+		},
+		TLC:      tlc,
+		router:   router,
+		tcpProxy: tcpProxy,
+		served:   served,
+	}
+	if err := builder.
+		ControllerManagedBy(mgr).
+		Named("serve").
+		Watches(&gatewayapi_alpha.TCPRoute{}, serveController.enqueueMachine()).
+		Watches(&gatewayapi.HTTPRoute{}, serveController.enqueueMachine()).
+		Watches(&gatewayapi.Gateway{}, serveController.enqueueMachine()).
+		Watches(&v1.Service{}, serveController.enqueueForService()).
+		Watches(&discoveryv1.EndpointSlice{}, serveController.enqueueForService()).
+		Watches(&gatewayapi.ReferenceGrant{}, serveController.enqueueMachine()).
+		Watches(&v1.Namespace{}, serveController.enqueueMachine()).
+		WatchesRawSource(&source.Channel{Source: nodeChangedServe}, serveController.enqueueMachine()).
+		Complete(serveController); err != nil {
+		return err
+	}
+
+	gatewayController := &GatewayController{
+		routeController: routeController{
+			Client:  mgr.GetClient(),
+			Logger:  logger.WithValues("resource", "Gateway"),
+			Name:    name,
+			Gateway: gateway,
+		},
+		TLC: tlc,
+	}
 	if err := builder.
 		ControllerManagedBy(mgr).
 		For(&gatewayapi.Gateway{}).
-		Complete(&GatewayController{
-			Client: mgr.GetClient(),
-			TLC:    &tlc,
-			Logger: logger.WithValues("resource", "Gateway"),
-		}); err != nil {
+		Watches(&gatewayapi_alpha.TCPRoute{}, gatewayController.enqueueServed()).
+		Watches(&gatewayapi.HTTPRoute{}, gatewayController.enqueueServed()).
+		Watches(&v1.Namespace{}, gatewayController.enqueueServed()).
+		WatchesRawSource(&source.Channel{Source: served}, gatewayController.enqueueServed()).
+		WatchesRawSource(&source.Channel{Source: nodeChangedGateway}, gatewayController.enqueueServed()).
+		Complete(gatewayController); err != nil {
 		return err
 	}
 
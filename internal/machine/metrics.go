@@ -0,0 +1,54 @@
+package machine
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	backendState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tailway_machine_backend_state",
+		Help: "The tailscale backend state of the machine, 1 for the current state.",
+	}, []string{"state"})
+	tcpPortHandlers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tailway_machine_tcp_port_handlers",
+		Help: "Ports with a handler in the serve config of the machine.",
+	})
+	certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tailway_machine_certificate_expiry_timestamp_seconds",
+		Help: "When the TLS certificate for the DNS name of the machine expires.",
+	}, []string{"name"})
+)
+
+// registerMetrics registers the metrics of the machine.
+func registerMetrics() error {
+	for _, collector := range []prometheus.Collector{backendState, tcpPortHandlers, certExpiry} {
+		if err := metrics.Registry.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBackendState reports state as the only current backend state.
+func setBackendState(state string) {
+	backendState.Reset()
+	backendState.WithLabelValues(state).Set(1)
+}
+
+// setCertExpiry reports when the first certificate in certPEM for name
+// expires.
+func setCertExpiry(name string, certPEM []byte) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return
+	}
+	certExpiry.WithLabelValues(name).Set(float64(cert.NotAfter.Unix()))
+}
@@ -0,0 +1,285 @@
+package machine
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	"github.com/michaelbeaumont/tailway/pkg"
+)
+
+// routeController holds what every route controller of a machine needs to
+// find the listeners it's responsible for.
+type routeController struct {
+	client.Client
+	Logger logr.Logger
+	// Name is the DNS name of the machine
+	Name *machineName
+	// Gateway is the Gateway the machine serves
+	Gateway types.NamespacedName
+}
+
+type portProtocol struct {
+	name     gatewayapi.SectionName
+	port     gatewayapi.PortNumber
+	protocol gatewayapi.ProtocolType
+}
+
+// parentAttachment is a parentRef of a route to a Gateway served by this
+// machine along with the listeners it selects.
+type parentAttachment struct {
+	ref       gatewayapi.ParentReference
+	listeners []portProtocol
+	// notAllowed is set if the parentRef selects listeners that don't allow
+	// routes from the route's namespace
+	notAllowed bool
+}
+
+// relevantGatewayListeners returns the attachment of parentRef to the
+// listeners with one of the given protocols that are selected by its
+// sectionName and port and allow routes from routeNamespace. It returns nil
+// if parentRef isn't a tailway Gateway served by this machine at all.
+func (ctrlr *routeController) relevantGatewayListeners(
+	ctx context.Context,
+	routeNamespace string,
+	parentRef gatewayapi.ParentReference,
+	protocols ...gatewayapi.ProtocolType,
+) (*parentAttachment, error) {
+	ctrlr.Logger.V(1).Info("checking ParentRef", "kind", *parentRef.Kind, "group", *parentRef.Group)
+	if string(*parentRef.Kind) != "Gateway" || string(*parentRef.Group) != gatewayapi.GroupVersion.Group {
+		return nil, nil
+	}
+
+	parentNamespace := routeNamespace
+	if parentRef.Namespace != nil {
+		parentNamespace = string(*parentRef.Namespace)
+	}
+	ctrlr.Logger.V(1).Info("checking Gateway parent", "name", parentRef.Name, "namespace", parentNamespace)
+	gateway := &gatewayapi.Gateway{}
+	if err := ctrlr.Get(ctx, types.NamespacedName{Name: string(parentRef.Name), Namespace: parentNamespace}, gateway); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	ctrlr.Logger.V(1).Info("checking GatewayClass of parent Gateway", "name", gateway.Spec.GatewayClassName)
+	class := &gatewayapi.GatewayClass{}
+	if err := ctrlr.Get(ctx, types.NamespacedName{Name: string(gateway.Spec.GatewayClassName)}, class); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if class.Spec.ControllerName != pkg.ControllerName {
+		return nil, nil
+	}
+
+	ctrlr.Logger.V(1).Info("checking addresses of parent tailway Gateway", "addresses", gateway.Spec.Addresses)
+	if !ctrlr.servedByMachine(gateway) {
+		return nil, nil
+	}
+
+	attachment := &parentAttachment{ref: parentRef}
+
+	for _, listener := range gateway.Spec.Listeners {
+		if !hasProtocol(protocols, listener.Protocol) {
+			continue
+		}
+		if parentRef.SectionName != nil && *parentRef.SectionName != listener.Name {
+			continue
+		}
+		if parentRef.Port != nil && *parentRef.Port != listener.Port {
+			continue
+		}
+		allowed, err := ctrlr.allowsNamespace(ctx, gateway, listener, routeNamespace)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			attachment.notAllowed = true
+			continue
+		}
+		attachment.listeners = append(
+			attachment.listeners,
+			portProtocol{name: listener.Name, port: listener.Port, protocol: listener.Protocol},
+		)
+	}
+
+	return attachment, nil
+}
+
+// allowsNamespace checks whether listener of gateway accepts routes from
+// routeNamespace.
+func (ctrlr *routeController) allowsNamespace(
+	ctx context.Context,
+	gateway *gatewayapi.Gateway,
+	listener gatewayapi.Listener,
+	routeNamespace string,
+) (bool, error) {
+	from := gatewayapi.NamespacesFromSame
+	var selector *metav1.LabelSelector
+	if listener.AllowedRoutes != nil && listener.AllowedRoutes.Namespaces != nil {
+		if listener.AllowedRoutes.Namespaces.From != nil {
+			from = *listener.AllowedRoutes.Namespaces.From
+		}
+		selector = listener.AllowedRoutes.Namespaces.Selector
+	}
+
+	switch from {
+	case gatewayapi.NamespacesFromAll:
+		return true, nil
+	case gatewayapi.NamespacesFromSame:
+		return routeNamespace == gateway.Namespace, nil
+	case gatewayapi.NamespacesFromSelector:
+		if selector == nil {
+			return false, nil
+		}
+		labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			ctrlr.Logger.Info("invalid allowedRoutes selector", "listener", listener.Name, "error", err.Error())
+			return false, nil
+		}
+		namespace := v1.Namespace{}
+		if err := ctrlr.Get(ctx, types.NamespacedName{Name: routeNamespace}, &namespace); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		return labelSelector.Matches(labels.Set(namespace.Labels)), nil
+	default:
+		return false, nil
+	}
+}
+
+// servedByMachine checks whether gateway is the Gateway of this machine.
+func (ctrlr *routeController) servedByMachine(gateway *gatewayapi.Gateway) bool {
+	return client.ObjectKeyFromObject(gateway) == ctrlr.Gateway
+}
+
+// attachments returns the parentRefs to Gateways served by this machine with
+// the listeners they select.
+func (ctrlr *routeController) attachments(
+	ctx context.Context,
+	routeNamespace string,
+	parentRefs []gatewayapi.ParentReference,
+	protocols ...gatewayapi.ProtocolType,
+) ([]parentAttachment, error) {
+	var attachments []parentAttachment
+
+	for _, parentRef := range parentRefs {
+		attachment, err := ctrlr.relevantGatewayListeners(ctx, routeNamespace, parentRef, protocols...)
+		if err != nil {
+			return nil, err
+		}
+
+		if attachment != nil {
+			attachments = append(attachments, *attachment)
+		}
+	}
+
+	return attachments, nil
+}
+
+// attachedListeners returns all listeners selected by attachments.
+func attachedListeners(attachments []parentAttachment) []portProtocol {
+	var gatewayPortProtocols []portProtocol
+	for _, attachment := range attachments {
+		gatewayPortProtocols = append(gatewayPortProtocols, attachment.listeners...)
+	}
+	return gatewayPortProtocols
+}
+
+// notAttached is the Accepted condition for an attachment without any
+// listeners.
+func notAttached(generation int64, attachment parentAttachment) metav1.Condition {
+	if attachment.notAllowed {
+		return metav1.Condition{
+			ObservedGeneration: generation,
+			Type:               string(gatewayapi.RouteConditionAccepted),
+			Status:             metav1.ConditionFalse,
+			Reason:             string(gatewayapi.RouteReasonNotAllowedByListeners),
+			Message:            "the listeners don't allow routes from this namespace",
+		}
+	}
+	return metav1.Condition{
+		ObservedGeneration: generation,
+		Type:               string(gatewayapi.RouteConditionAccepted),
+		Status:             metav1.ConditionFalse,
+		Reason:             string(gatewayapi.RouteReasonNoMatchingParent),
+		Message:            "no listener matches the sectionName, port and route kind",
+	}
+}
+
+func hasProtocol(protocols []gatewayapi.ProtocolType, protocol gatewayapi.ProtocolType) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// setParentStatus sets conditions on the entry of status belonging to ref,
+// adding one for tailway if it's missing.
+func (ctrlr *routeController) setParentStatus(
+	status *gatewayapi.RouteStatus,
+	ref gatewayapi.ParentReference,
+	conditions ...metav1.Condition,
+) {
+	var existingStatusEntry *int
+
+	for i := range status.Parents {
+		j := i
+		if status.Parents[j].ControllerName == pkg.ControllerName &&
+			reflect.DeepEqual(status.Parents[j].ParentRef, ref) {
+			existingStatusEntry = &j
+		}
+	}
+
+	if existingStatusEntry == nil {
+		previousStatus := gatewayapi.RouteParentStatus{
+			ParentRef:      ref,
+			ControllerName: pkg.ControllerName,
+			Conditions:     []metav1.Condition{},
+		}
+		status.Parents = append(status.Parents, previousStatus)
+		entry := len(status.Parents) - 1
+		existingStatusEntry = &entry
+		ctrlr.Logger.Info("added status", "status", status)
+	}
+
+	for _, condition := range conditions {
+		meta.SetStatusCondition(&status.Parents[*existingStatusEntry].Conditions, condition)
+	}
+}
+
+// pruneParentStatuses removes the entries of tailway in status for parents no
+// longer in specRefs.
+func pruneParentStatuses(status *gatewayapi.RouteStatus, specRefs []gatewayapi.ParentReference) {
+	parents := []gatewayapi.RouteParentStatus{}
+	for _, parentStatus := range status.Parents {
+		if parentStatus.ControllerName == pkg.ControllerName && !containsRef(specRefs, parentStatus.ParentRef) {
+			continue
+		}
+		parents = append(parents, parentStatus)
+	}
+	status.Parents = parents
+}
+
+func containsRef(refs []gatewayapi.ParentReference, ref gatewayapi.ParentReference) bool {
+	for i := range refs {
+		if reflect.DeepEqual(refs[i], ref) {
+			return true
+		}
+	}
+	return false
+}
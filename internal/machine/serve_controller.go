@@ -0,0 +1,337 @@
+package machine
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayapi_alpha "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+
+	"github.com/michaelbeaumont/tailway/pkg"
+)
+
+// ServeController replaces the serve config of the machine with one built
+// from all routes currently attached to it, so that removed routes, listeners
+// and parentRefs stop being served. tailscaled dials the backends and the
+// local router and proxy from the pod's network namespace, so this works the
+// same with userspace networking.
+type ServeController struct {
+	routeController
+	TLC      *tailscale.LocalClient
+	router   *httpRouter
+	tcpProxy *tcpProxy
+	served   chan<- event.GenericEvent
+}
+
+// enqueueMachine maps every object to the single request the ServeController
+// handles.
+func (ctrlr *ServeController) enqueueMachine() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(context.Context, client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: ctrlr.Name.Get()}}}
+	})
+}
+
+// enqueueForService maps Services that routes refer to and their
+// EndpointSlices to the request the ServeController handles.
+func (ctrlr *ServeController) enqueueForService() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
+		service, ok := serviceKey(obj)
+		if !ok {
+			return nil
+		}
+
+		key := client.MatchingFields{backendServiceField: service}
+		for _, routes := range []client.ObjectList{&gatewayapi_alpha.TCPRouteList{}, &gatewayapi.HTTPRouteList{}} {
+			if err := ctrlr.List(ctx, routes, key); err != nil {
+				ctrlr.Logger.Error(err, "unexpected error listing routes")
+				return nil
+			}
+			if meta.LenList(routes) > 0 {
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: ctrlr.Name.Get()}}}
+			}
+		}
+		return nil
+	})
+}
+
+func (ctrlr *ServeController) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	serveConfig := &ipn.ServeConfig{}
+	routerMounts := map[routerMount][]httpRouterRule{}
+	proxiedPorts := map[uint16][]weightedBackend{}
+
+	owners, err := ctrlr.tcpListenerOwners(ctx)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	tcpRoutes := gatewayapi_alpha.TCPRouteList{}
+	if err := ctrlr.List(ctx, &tcpRoutes); err != nil {
+		return reconcile.Result{}, err
+	}
+	sort.Slice(tcpRoutes.Items, func(i, j int) bool {
+		return olderThan(&tcpRoutes.Items[i], &tcpRoutes.Items[j])
+	})
+	for i := range tcpRoutes.Items {
+		if err := ctrlr.serveTCPRoute(ctx, serveConfig, proxiedPorts, owners, &tcpRoutes.Items[i]); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	proxyAddresses, err := ctrlr.tcpProxy.Replace(proxiedPorts)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrap(err, "couldn't start TCP proxy")
+	}
+	for port := range proxiedPorts {
+		address, ok := proxyAddresses[port]
+		if !ok {
+			// the proxy is shutting down, rather not serve the port than
+			// forward it to just one of the backends
+			ctrlr.Logger.Info("TCP proxy isn't listening, not serving port", "port", port)
+			delete(serveConfig.TCP, port)
+			continue
+		}
+		serveConfig.TCP[port].TCPForward = address
+	}
+
+	httpRoutes := gatewayapi.HTTPRouteList{}
+	if err := ctrlr.List(ctx, &httpRoutes); err != nil {
+		return reconcile.Result{}, err
+	}
+	sort.Slice(httpRoutes.Items, func(i, j int) bool {
+		return olderThan(&httpRoutes.Items[i], &httpRoutes.Items[j])
+	})
+	for i := range httpRoutes.Items {
+		if err := ctrlr.serveHTTPRoute(ctx, serveConfig, routerMounts, &httpRoutes.Items[i]); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	ctrlr.router.Replace(routerMounts)
+	ctrlr.addWebHandlers(serveConfig, routerMounts)
+
+	if err := ctrlr.allowFunnel(ctx, serveConfig); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	current, err := ctrlr.TLC.GetServeConfig(ctx)
+	if err != nil {
+		return reconcile.Result{}, errors.Wrap(err, "couldn't get serve config")
+	}
+	if current != nil && reflect.DeepEqual(*current, *serveConfig) {
+		return reconcile.Result{}, nil
+	}
+
+	ctrlr.Logger.Info("replacing serve config", "config", serveConfig)
+
+	if err := ctrlr.TLC.SetServeConfig(ctx, serveConfig); err != nil {
+		return reconcile.Result{}, errors.Wrap(err, "couldn't set serve config")
+	}
+
+	select {
+	case ctrlr.served <- event.GenericEvent{Object: &gatewayapi.Gateway{}}:
+	default:
+		// a notification is already pending
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// olderThan orders objects by age, using the name to break ties.
+func olderThan(a, b client.Object) bool {
+	aCreated, bCreated := a.GetCreationTimestamp(), b.GetCreationTimestamp()
+	if !aCreated.Equal(&bCreated) {
+		return aCreated.Before(&bCreated)
+	}
+	return client.ObjectKeyFromObject(a).String() < client.ObjectKeyFromObject(b).String()
+}
+
+// serveTCPRoute adds handlers for the ports owned by route. Ports with more
+// than one backend address are added to proxiedPorts, their handlers still
+// need to be pointed at the TCP proxy.
+func (ctrlr *ServeController) serveTCPRoute(
+	ctx context.Context,
+	serveConfig *ipn.ServeConfig,
+	proxiedPorts map[uint16][]weightedBackend,
+	owners map[gatewayapi.PortNumber]types.NamespacedName,
+	route *gatewayapi_alpha.TCPRoute,
+) error {
+	attachments, err := ctrlr.attachments(ctx, route.Namespace, route.Spec.ParentRefs, tcpRouteProtocols...)
+	if err != nil {
+		return err
+	}
+
+	var gatewayPortProtocols []portProtocol
+	for _, listener := range attachedListeners(attachments) {
+		if owners[listener.port] == client.ObjectKeyFromObject(route) {
+			gatewayPortProtocols = append(gatewayPortProtocols, listener)
+		}
+	}
+	if len(gatewayPortProtocols) == 0 {
+		return nil
+	}
+
+	resolved, _, err := ctrlr.resolveTCPBackends(ctx, route)
+	if err != nil {
+		return err
+	}
+	var backends []weightedBackend
+	for _, backend := range resolved {
+		if backend.weight > 0 && len(backend.addresses) > 0 {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == 0 {
+		return nil
+	}
+	// a single address can be forwarded to by tailscaled directly
+	direct := len(backends) == 1 && len(backends[0].addresses) == 1
+
+	if serveConfig.TCP == nil {
+		serveConfig.TCP = map[uint16]*ipn.TCPPortHandler{}
+	}
+
+	for _, portProtocol := range gatewayPortProtocols {
+		terminateTLS := ""
+		if portProtocol.protocol == gatewayapi.TLSProtocolType {
+			terminateTLS = ctrlr.Name.Get()
+		}
+		handler := &ipn.TCPPortHandler{
+			TCPForward:   backends[0].addresses[0],
+			TerminateTLS: terminateTLS,
+		}
+		if !direct {
+			proxiedPorts[uint16(portProtocol.port)] = backends
+		}
+		serveConfig.TCP[uint16(portProtocol.port)] = handler
+
+		ctrlr.Logger.V(1).Info("adding handler", "port", portProtocol.port, "handler", handler)
+	}
+
+	return nil
+}
+
+func (ctrlr *ServeController) serveHTTPRoute(
+	ctx context.Context,
+	serveConfig *ipn.ServeConfig,
+	routerMounts map[routerMount][]httpRouterRule,
+	route *gatewayapi.HTTPRoute,
+) error {
+	attachments, err := ctrlr.attachments(ctx, route.Namespace, route.Spec.ParentRefs, httpRouteProtocols...)
+	if err != nil {
+		return err
+	}
+	gatewayPortProtocols := attachedListeners(attachments)
+	if len(gatewayPortProtocols) == 0 {
+		return nil
+	}
+
+	mounts, accepted, _, err := ctrlr.acceptHTTPRoute(ctx, route)
+	if err != nil || accepted.Status != metav1.ConditionTrue {
+		return err
+	}
+
+	if serveConfig.TCP == nil {
+		serveConfig.TCP = map[uint16]*ipn.TCPPortHandler{}
+	}
+
+	for _, portProtocol := range gatewayPortProtocols {
+		handler := &ipn.TCPPortHandler{
+			HTTPS: portProtocol.protocol == gatewayapi.HTTPSProtocolType,
+			HTTP:  portProtocol.protocol == gatewayapi.HTTPProtocolType,
+		}
+		if existing, ok := serveConfig.TCP[uint16(portProtocol.port)]; ok && !reflect.DeepEqual(existing, handler) {
+			ctrlr.Logger.Info("port already served by an older route", "port", portProtocol.port, "HTTPRoute", client.ObjectKeyFromObject(route))
+			continue
+		}
+		serveConfig.TCP[uint16(portProtocol.port)] = handler
+
+		hostPort := ipn.HostPort(net.JoinHostPort(ctrlr.Name.Get(), strconv.Itoa(int(portProtocol.port))))
+		for mount, rules := range mounts {
+			routerMount := routerMount{hostPort: hostPort, mount: mount}
+			routerMounts[routerMount] = append(routerMounts[routerMount], rules...)
+		}
+	}
+
+	return nil
+}
+
+// addWebHandlers points every mount point either directly at its backend or
+// at the router.
+func (ctrlr *ServeController) addWebHandlers(
+	serveConfig *ipn.ServeConfig,
+	routerMounts map[routerMount][]httpRouterRule,
+) {
+	for routerMount := range routerMounts {
+		if serveConfig.Web == nil {
+			serveConfig.Web = map[ipn.HostPort]*ipn.WebServerConfig{}
+		}
+		webConfig, ok := serveConfig.Web[routerMount.hostPort]
+		if !ok {
+			webConfig = &ipn.WebServerConfig{Handlers: map[string]*ipn.HTTPHandler{}}
+			serveConfig.Web[routerMount.hostPort] = webConfig
+		}
+
+		proxy := routerMount.proxyTarget()
+		if backend, ok := ctrlr.router.Direct(routerMount); ok {
+			proxy = "http://" + backend + strings.TrimSuffix(routerMount.mount, "/")
+		}
+		handler := &ipn.HTTPHandler{Proxy: proxy}
+		webConfig.Handlers[routerMount.mount] = handler
+
+		ctrlr.Logger.V(1).Info("adding handler", "hostPort", routerMount.hostPort, "mount", routerMount.mount, "handler", handler)
+	}
+}
+
+// allowFunnel exposes the served listeners of the Gateway that opted into
+// Funnel to the internet, as far as the tailnet permits it.
+func (ctrlr *ServeController) allowFunnel(ctx context.Context, serveConfig *ipn.ServeConfig) error {
+	gateway := gatewayapi.Gateway{}
+	if err := ctrlr.Get(ctx, ctrlr.Gateway, &gateway); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if _, ok := gateway.Annotations[pkg.FunnelAnnotation]; !ok {
+		return nil
+	}
+
+	status, err := ctrlr.TLC.Status(ctx)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get tailscale status")
+	}
+	var capabilities []string
+	if status.Self != nil {
+		capabilities = status.Self.Capabilities
+	}
+
+	for _, listener := range gateway.Spec.Listeners {
+		if !wantsFunnel(&gateway, listener) {
+			continue
+		}
+		if reason, _ := funnelProblem(listener, capabilities); reason != "" {
+			continue
+		}
+		if served, _ := servesListener(serveConfig, listener); !served {
+			continue
+		}
+		if serveConfig.AllowFunnel == nil {
+			serveConfig.AllowFunnel = map[ipn.HostPort]bool{}
+		}
+		hostPort := ipn.HostPort(net.JoinHostPort(ctrlr.Name.Get(), strconv.Itoa(int(listener.Port))))
+		serveConfig.AllowFunnel[hostPort] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+
+	"github.com/michaelbeaumont/tailway/pkg"
+)
+
+const (
+	minStartupBackoff = time.Second
+	maxStartupBackoff = 30 * time.Second
+)
+
+// nodeWaiter waits for tailscaled to be running before setting up the
+// controllers, which need the DNS name of the machine. Meanwhile it reports
+// the backend state in the status of the Gateway.
+type nodeWaiter struct {
+	client.Client
+	Logger  logr.Logger
+	TLC     *tailscale.LocalClient
+	Gateway types.NamespacedName
+	// Setup is called with the DNS name of the machine once it's running
+	Setup func(name string) error
+	// State is updated with every state we see until tailscale is running
+	State *tailscaleState
+}
+
+// tailscaleState is the last known backend state of tailscaled, the machine is
+// only ready while it's Running. It's updated by the nodeWaiter until the
+// controllers are set up and by the ipnWatcher afterwards.
+type tailscaleState struct {
+	state atomic.Pointer[string]
+}
+
+func (state *tailscaleState) Set(current string) {
+	state.state.Store(&current)
+}
+
+// ReadyCheck fails unless tailscale is running.
+func (state *tailscaleState) ReadyCheck(*http.Request) error {
+	current := state.state.Load()
+	if current == nil {
+		return errors.New("tailscale isn't running yet")
+	}
+	if *current != ipn.Running.String() {
+		return errors.Errorf("tailscale is in state %s", *current)
+	}
+	return nil
+}
+
+// Start polls tailscaled with backoff until it's running.
+func (waiter *nodeWaiter) Start(ctx context.Context) error {
+	backoff := minStartupBackoff
+	lastState := ""
+	for {
+		status, err := waiter.TLC.Status(ctx)
+		switch {
+		case err != nil:
+			waiter.Logger.Error(err, "couldn't get tailscale status")
+		case status.BackendState == ipn.Running.String() && status.Self != nil && status.Self.DNSName != "":
+			name := strings.TrimSuffix(status.Self.DNSName, ".")
+			waiter.Logger.Info("tailscale is running", "name", name)
+			if err := waiter.Setup(name); err != nil {
+				return err
+			}
+			// the ipnWatcher started by Setup takes over from here
+			waiter.State.Set(status.BackendState)
+			return nil
+		default:
+			if status.BackendState != lastState {
+				waiter.Logger.Info("waiting for tailscale", "state", status.BackendState)
+				lastState = status.BackendState
+				backoff = minStartupBackoff
+			}
+			setBackendState(status.BackendState)
+			waiter.State.Set(status.BackendState)
+			if err := waiter.setStatus(ctx, status); err != nil {
+				waiter.Logger.Error(err, "couldn't set Gateway status")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// setStatus reports the Gateway as not programmed because of the backend
+// state in status.
+func (waiter *nodeWaiter) setStatus(ctx context.Context, status *ipnstate.Status) error {
+	gateway := &gatewayapi.Gateway{}
+	if err := waiter.Get(ctx, waiter.Gateway, gateway); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	orig := gateway.DeepCopy()
+
+	meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+		ObservedGeneration: gateway.GetGeneration(),
+		Type:               string(gatewayapi.GatewayConditionProgrammed),
+		Status:             metav1.ConditionFalse,
+		Reason:             string(gatewayapi.GatewayReasonPending),
+		Message:            backendStateMessage(status),
+	})
+
+	if reflect.DeepEqual(orig.Status, gateway.Status) {
+		return nil
+	}
+
+	// the tailnet controller patches the same conditions
+	return waiter.Status().Patch(ctx, gateway, client.MergeFromWithOptions(orig, client.MergeFromWithOptimisticLock{}))
+}
+
+// backendStateMessage describes why tailscale isn't running.
+func backendStateMessage(status *ipnstate.Status) string {
+	message := pkg.BackendStateMessage(status.BackendState)
+	if status.AuthURL != "" {
+		message += fmt.Sprintf(", log in at %s", status.AuthURL)
+	}
+	if len(status.Health) > 0 {
+		message += ": " + strings.Join(status.Health, ", ")
+	}
+	return message
+}
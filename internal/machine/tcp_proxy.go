@@ -0,0 +1,139 @@
+package machine
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// tcpProxy spreads the connections tailscaled forwards for a port across
+// multiple weighted backends, which TCPPortHandler can't do by itself.
+// tailscaled forwards a port to a local listener of the proxy instead of
+// directly to a backend.
+type tcpProxy struct {
+	Logger logr.Logger
+
+	sync.Mutex
+	listeners map[uint16]*tcpProxyListener
+	closed    bool
+}
+
+type tcpProxyListener struct {
+	net.Listener
+
+	sync.RWMutex
+	backends []weightedBackend
+}
+
+func newTCPProxy(logger logr.Logger) *tcpProxy {
+	return &tcpProxy{
+		Logger:    logger,
+		listeners: map[uint16]*tcpProxyListener{},
+	}
+}
+
+// Replace sets the backends for each proxied port and returns the local
+// addresses tailscaled should forward those ports to. Listeners for ports
+// that are no longer proxied are closed.
+func (proxy *tcpProxy) Replace(ports map[uint16][]weightedBackend) (map[uint16]string, error) {
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	for port, listener := range proxy.listeners {
+		if _, ok := ports[port]; !ok {
+			listener.Close()
+			delete(proxy.listeners, port)
+		}
+	}
+
+	addresses := map[uint16]string{}
+	for port, backends := range ports {
+		listener, ok := proxy.listeners[port]
+		if !ok {
+			if proxy.closed {
+				continue
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			listener = &tcpProxyListener{Listener: l}
+			proxy.listeners[port] = listener
+			go proxy.serve(port, listener)
+		}
+
+		listener.Lock()
+		listener.backends = backends
+		listener.Unlock()
+
+		addresses[port] = listener.Addr().String()
+	}
+
+	return addresses, nil
+}
+
+func (proxy *tcpProxy) serve(port uint16, listener *tcpProxyListener) {
+	logger := proxy.Logger.WithValues("port", port)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.V(1).Info("stopped accepting connections", "error", err.Error())
+			return
+		}
+
+		listener.RLock()
+		backend, ok := pickBackend(listener.backends)
+		listener.RUnlock()
+		if !ok {
+			logger.Info("no backend available")
+			conn.Close()
+			continue
+		}
+
+		go proxy.forward(logger, conn, backend)
+	}
+}
+
+func (proxy *tcpProxy) forward(logger logr.Logger, conn net.Conn, backend string) {
+	defer conn.Close()
+
+	upstream, err := net.DialTimeout("tcp", backend, 10*time.Second)
+	if err != nil {
+		logger.Error(err, "couldn't connect to backend", "backend", backend)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	copyConn := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go copyConn(upstream, conn)
+	go copyConn(conn, upstream)
+	<-done
+	<-done
+}
+
+// Start closes all listeners once ctx is done.
+func (proxy *tcpProxy) Start(ctx context.Context) error {
+	<-ctx.Done()
+
+	proxy.Lock()
+	defer proxy.Unlock()
+
+	proxy.closed = true
+	for port, listener := range proxy.listeners {
+		listener.Close()
+		delete(proxy.listeners, port)
+	}
+
+	return nil
+}
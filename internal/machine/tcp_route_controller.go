@@ -2,244 +2,265 @@ package machine
 
 import (
 	"context"
-	"net"
+	"fmt"
 	"reflect"
-	"strconv"
+	"sort"
 	"strings"
 
-	"github.com/go-logr/logr"
-	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/meta"
+	"github.com/pkg/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	gatewayapi_alpha "sigs.k8s.io/gateway-api/apis/v1alpha2"
 	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
-	"tailscale.com/client/tailscale"
-	"tailscale.com/ipn"
-
-	"github.com/michaelbeaumont/tailway/pkg"
 )
 
 type TCPRouteController struct {
-	client.Client
-	Logger logr.Logger
-	Name   string
-	TLC    *tailscale.LocalClient
+	routeController
 }
 
-type portProtocol struct {
-	port     gatewayapi.PortNumber
-	protocol gatewayapi.ProtocolType
-}
+var tcpRouteProtocols = []gatewayapi.ProtocolType{gatewayapi.TCPProtocolType, gatewayapi.TLSProtocolType}
 
-func (ctrlr *TCPRouteController) relevantGatewayListeners(
-	ctx context.Context,
-	routeNamespace string,
-	parentRef gatewayapi.ParentReference,
-) ([]portProtocol, error) {
-	ctrlr.Logger.V(1).Info("checking ParentRef", "kind", *parentRef.Kind, "group", *parentRef.Group)
-	if string(*parentRef.Kind) != "Gateway" || string(*parentRef.Group) != gatewayapi.GroupVersion.Group {
-		return nil, nil
-	}
-
-	parentNamespace := routeNamespace
-	if parentRef.Namespace != nil {
-		parentNamespace = string(*parentRef.Namespace)
-	}
-	ctrlr.Logger.V(1).Info("checking Gateway parent", "name", parentRef.Name, "namespace", parentNamespace)
-	gateway := &gatewayapi.Gateway{}
-	if err := ctrlr.Get(ctx, types.NamespacedName{Name: string(parentRef.Name), Namespace: parentNamespace}, gateway); err != nil {
-		if errors.IsNotFound(err) {
-			return nil, nil
-		}
-		return nil, err
-	}
+// routeReasonConflicted is used when all listeners a TCPRoute selects are
+// already used by older TCPRoutes.
+const routeReasonConflicted gatewayapi.RouteConditionReason = "Conflicted"
 
-	ctrlr.Logger.V(1).Info("checking GatewayClass of parent Gateway", "name", gateway.Spec.GatewayClassName)
-	class := &gatewayapi.GatewayClass{}
-	if err := ctrlr.Get(ctx, types.NamespacedName{Name: string(gateway.Spec.GatewayClassName)}, class); err != nil {
-		if errors.IsNotFound(err) {
-			return nil, nil
+// enqueueAll maps every object to requests for all TCPRoutes, since a change
+// to one of them or to a Gateway can change which route wins a listener.
+func (ctrlr *TCPRouteController) enqueueAll() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, _ client.Object) []reconcile.Request {
+		routes := gatewayapi_alpha.TCPRouteList{}
+		if err := ctrlr.List(ctx, &routes); err != nil {
+			ctrlr.Logger.Error(err, "unexpected error listing TCPRoutes")
+			return nil
 		}
-		return nil, err
-	}
 
-	if class.Spec.ControllerName != pkg.ControllerName {
-		return nil, nil
-	}
-
-	ctrlr.Logger.V(1).Info("checking addresses of parent tailway Gateway", "addresses", gateway.Spec.Addresses)
-	var foundName bool
-	for _, address := range gateway.Spec.Addresses {
-		if *address.Type == gatewayapi.HostnameAddressType && strings.HasPrefix(ctrlr.Name, address.Value+".") {
-			foundName = true
+		var requests []reconcile.Request
+		for i := range routes.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKeyFromObject(&routes.Items[i]),
+			})
 		}
-	}
-
-	if !foundName {
-		return nil, nil
-	}
+		return requests
+	})
+}
 
-	var gatewayPortProtocols []portProtocol
+// enqueueForService maps Services to requests for the TCPRoutes referring to
+// them.
+func (ctrlr *TCPRouteController) enqueueForService() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
+		key, ok := serviceKey(obj)
+		if !ok {
+			return nil
+		}
 
-	for _, listener := range gateway.Spec.Listeners {
-		gatewayPortProtocols = append(
-			gatewayPortProtocols,
-			portProtocol{port: listener.Port, protocol: listener.Protocol},
-		)
-	}
+		routes := gatewayapi_alpha.TCPRouteList{}
+		if err := ctrlr.List(
+			ctx, &routes, client.MatchingFields{backendServiceField: key},
+		); err != nil {
+			ctrlr.Logger.Error(err, "unexpected error listing TCPRoutes")
+			return nil
+		}
 
-	return gatewayPortProtocols, nil
+		var requests []reconcile.Request
+		for i := range routes.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: client.ObjectKeyFromObject(&routes.Items[i]),
+			})
+		}
+		return requests
+	})
 }
 
 func (ctrlr *TCPRouteController) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 	route := &gatewayapi_alpha.TCPRoute{}
 	err := ctrlr.Get(ctx, req.NamespacedName, route)
 	if err != nil {
-		return reconcile.Result{}, err
+		return reconcile.Result{}, client.IgnoreNotFound(err)
 	}
 
-	var gatewayPortProtocols []portProtocol
-
-	var parentRefs []gatewayapi_alpha.ParentReference
-
-	for _, parentRef := range route.Spec.ParentRefs {
-		listeners, err := ctrlr.relevantGatewayListeners(ctx, route.Namespace, parentRef)
-		if err != nil {
-			return reconcile.Result{}, err
-		}
-
-		gatewayPortProtocols = append(
-			gatewayPortProtocols,
-			listeners...,
-		)
-
-		if len(listeners) > 0 {
-			parentRefs = append(parentRefs, parentRef)
-		}
+	attachments, err := ctrlr.attachments(ctx, route.Namespace, route.Spec.ParentRefs, tcpRouteProtocols...)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
-	if len(gatewayPortProtocols) == 0 {
-		return reconcile.Result{}, nil
+	owners, err := ctrlr.tcpListenerOwners(ctx)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
-	ctrlr.Logger.Info("reconciling", "HTTPRoute", req.NamespacedName, "portProtocols", gatewayPortProtocols)
+	ctrlr.Logger.Info("reconciling", "TCPRoute", req.NamespacedName, "portProtocols", attachedListeners(attachments))
 
-	if err := ctrlr.servePortProtocols(ctx, *route, gatewayPortProtocols); err != nil {
+	_, resolvedRefs, err := ctrlr.resolveTCPBackends(ctx, route)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	if err := ctrlr.setStatus(ctx, route, parentRefs); err != nil {
+	if err := ctrlr.setStatus(ctx, route, attachments, owners, resolvedRefs); err != nil {
 		return reconcile.Result{}, err
 	}
 
 	return reconcile.Result{}, nil
 }
 
-func (ctrlr *TCPRouteController) servePortProtocols(
+func (ctrlr *TCPRouteController) setStatus(
 	ctx context.Context,
-	route gatewayapi_alpha.TCPRoute,
-	gatewayPortProtocols []portProtocol,
+	route *gatewayapi_alpha.TCPRoute,
+	attachments []parentAttachment,
+	owners map[gatewayapi.PortNumber]types.NamespacedName,
+	resolvedRefs metav1.Condition,
 ) error {
-	serveConfig, err := ctrlr.TLC.GetServeConfig(ctx)
-	if err != nil {
-		return err
+	orig := route.DeepCopy()
+
+	pruneParentStatuses(&route.Status.RouteStatus, route.Spec.ParentRefs)
+	for _, attachment := range attachments {
+		ctrlr.setParentStatus(
+			&route.Status.RouteStatus,
+			attachment.ref,
+			tcpRouteAccepted(route, attachment, owners),
+			resolvedRefs,
+		)
 	}
 
-	if serveConfig == nil {
-		serveConfig = &ipn.ServeConfig{}
-	}
-	if serveConfig.TCP == nil {
-		serveConfig.TCP = map[uint16]*ipn.TCPPortHandler{}
+	if reflect.DeepEqual(orig.Status, route.Status) {
+		return nil
 	}
 
-	backend := route.Spec.Rules[0].BackendRefs[0].BackendObjectReference
-	namespace := route.Namespace
-	if backend.Namespace != nil {
-		namespace = string(*backend.Namespace)
+	return ctrlr.Status().Patch(ctx, route, client.MergeFrom(orig))
+}
+
+// tcpRouteAccepted returns the Accepted condition of route for attachment,
+// which isn't accepted if older routes own all its listeners.
+func tcpRouteAccepted(
+	route *gatewayapi_alpha.TCPRoute,
+	attachment parentAttachment,
+	owners map[gatewayapi.PortNumber]types.NamespacedName,
+) metav1.Condition {
+	if len(attachment.listeners) == 0 {
+		return notAttached(route.GetGeneration(), attachment)
 	}
 
-	svc := v1.Service{}
-	if err := ctrlr.Get(
-		ctx,
-		types.NamespacedName{Name: string(backend.Name), Namespace: namespace},
-		&svc,
-	); err != nil {
-		if errors.IsNotFound(err) {
-			return nil
+	var conflicts []string
+	for _, listener := range attachment.listeners {
+		owner := owners[listener.port]
+		if owner == client.ObjectKeyFromObject(route) {
+			return metav1.Condition{
+				ObservedGeneration: route.GetGeneration(),
+				Type:               string(gatewayapi_alpha.RouteConditionAccepted),
+				Status:             metav1.ConditionTrue,
+				Reason:             string(gatewayapi_alpha.RouteReasonAccepted),
+			}
 		}
-		return err
+		conflicts = append(conflicts, fmt.Sprintf("%s is used by %s", listener.name, owner))
 	}
 
-	tcpForward := net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(*backend.Port)))
+	return metav1.Condition{
+		ObservedGeneration: route.GetGeneration(),
+		Type:               string(gatewayapi_alpha.RouteConditionAccepted),
+		Status:             metav1.ConditionFalse,
+		Reason:             string(routeReasonConflicted),
+		Message:            "listeners are already used by older TCPRoutes: " + strings.Join(conflicts, ", "),
+	}
+}
 
-	for _, portProtocol := range gatewayPortProtocols {
-		terminateTLS := ""
-		if portProtocol.protocol == gatewayapi.TLSProtocolType {
-			terminateTLS = ctrlr.Name
+// tcpListenerOwners returns the TCPRoute that gets each port of this machine.
+// When several TCPRoutes select the same listener, the oldest one wins.
+func (ctrlr *routeController) tcpListenerOwners(
+	ctx context.Context,
+) (map[gatewayapi.PortNumber]types.NamespacedName, error) {
+	routes := gatewayapi_alpha.TCPRouteList{}
+	if err := ctrlr.List(ctx, &routes); err != nil {
+		return nil, err
+	}
+	sort.Slice(routes.Items, func(i, j int) bool {
+		return olderThan(&routes.Items[i], &routes.Items[j])
+	})
+
+	owners := map[gatewayapi.PortNumber]types.NamespacedName{}
+	for i := range routes.Items {
+		route := &routes.Items[i]
+		attachments, err := ctrlr.attachments(ctx, route.Namespace, route.Spec.ParentRefs, tcpRouteProtocols...)
+		if err != nil {
+			return nil, err
 		}
-		handler := &ipn.TCPPortHandler{
-			TCPForward:   tcpForward,
-			TerminateTLS: terminateTLS,
+		for _, listener := range attachedListeners(attachments) {
+			if _, ok := owners[listener.port]; !ok {
+				owners[listener.port] = client.ObjectKeyFromObject(route)
+			}
 		}
-		serveConfig.TCP[uint16(portProtocol.port)] = handler
-
-		ctrlr.Logger.Info("adding handler", "port", portProtocol.port, "handler", handler)
 	}
 
-	return ctrlr.TLC.SetServeConfig(ctx, serveConfig)
+	return owners, nil
 }
 
-func (ctrlr *TCPRouteController) setStatus(
+// resolveTCPBackends returns the backends of all rules of route along with
+// the ResolvedRefs condition for it.
+func (ctrlr *routeController) resolveTCPBackends(
 	ctx context.Context,
 	route *gatewayapi_alpha.TCPRoute,
-	refs []gatewayapi_alpha.ParentReference,
-) error {
-	orig := route.DeepCopyObject().(client.Object)
+) ([]weightedBackend, metav1.Condition, error) {
+	resolvedRefs := metav1.Condition{
+		ObservedGeneration: route.GetGeneration(),
+		Type:               string(gatewayapi_alpha.RouteConditionResolvedRefs),
+		Status:             metav1.ConditionTrue,
+		Reason:             string(gatewayapi_alpha.RouteReasonResolvedRefs),
+	}
 
-	existingStatuses := map[int]struct{}{}
+	var backendRefs []gatewayapi.BackendRef
+	for _, rule := range route.Spec.Rules {
+		backendRefs = append(backendRefs, rule.BackendRefs...)
+	}
 
-	for i, parentStatus := range route.Status.Parents {
-		if parentStatus.ControllerName == pkg.ControllerName {
-			existingStatuses[i] = struct{}{}
-		}
+	if len(backendRefs) == 0 {
+		resolvedRefs.Status = metav1.ConditionFalse
+		resolvedRefs.Reason = string(gatewayapi_alpha.RouteReasonBackendNotFound)
+		resolvedRefs.Message = "TCPRoute has no backendRefs"
+		return nil, resolvedRefs, nil
 	}
 
-	for _, ref := range refs {
-		condition := metav1.Condition{
-			ObservedGeneration: route.GetGeneration(),
-			Type:               string(gatewayapi_alpha.RouteConditionAccepted),
-			Status:             metav1.ConditionTrue,
-			Reason:             string(gatewayapi_alpha.RouteReasonAccepted),
+	var backends []weightedBackend
+	var notPermitted, unresolved []string
+	invalidKind := false
+	for _, backendRef := range backendRefs {
+		if !isServiceRef(backendRef.BackendObjectReference) {
+			invalidKind = true
+			continue
 		}
 
-		var existingStatusEntry *int
+		permitted, err := ctrlr.backendPermitted(ctx, "TCPRoute", route.Namespace, backendRef.BackendObjectReference)
+		if err != nil {
+			return nil, resolvedRefs, err
+		}
+		if !permitted {
+			notPermitted = append(notPermitted, fmt.Sprintf("%s/%s", *backendRef.Namespace, backendRef.Name))
+			continue
+		}
 
-		for i := range existingStatuses {
-			j := i
-			if reflect.DeepEqual(route.Status.Parents[j].ParentRef, ref) {
-				existingStatusEntry = &j
-				delete(existingStatuses, j)
-			}
+		addresses, err := ctrlr.resolveBackend(ctx, route.Namespace, backendRef.BackendObjectReference)
+		var unresolvedErr unresolvedError
+		if errors.As(err, &unresolvedErr) {
+			unresolved = append(unresolved, err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, resolvedRefs, err
 		}
 
-		if existingStatusEntry == nil {
-			previousStatus := gatewayapi_alpha.RouteParentStatus{
-				ParentRef:      ref,
-				ControllerName: pkg.ControllerName,
-				Conditions:     []metav1.Condition{},
-			}
-			route.Status.Parents = append(route.Status.Parents, previousStatus)
-			entry := len(route.Status.Parents) - 1
-			existingStatusEntry = &entry
-			ctrlr.Logger.Info("added status", "status", route.Status)
+		var weight int32 = 1
+		if backendRef.Weight != nil {
+			weight = *backendRef.Weight
 		}
+		backends = append(backends, weightedBackend{addresses: addresses, weight: weight})
+	}
 
-		meta.SetStatusCondition(&route.Status.Parents[*existingStatusEntry].Conditions, condition)
+	if invalidKind {
+		resolvedRefs.Status = metav1.ConditionFalse
+		resolvedRefs.Reason = string(gatewayapi_alpha.RouteReasonInvalidKind)
+		resolvedRefs.Message = "only Service backendRefs are supported"
+		return backends, resolvedRefs, nil
 	}
 
-	return ctrlr.Status().Patch(ctx, route, client.MergeFrom(orig))
+	return backends, resolvedRefsCondition(route.GetGeneration(), notPermitted, unresolved), nil
 }
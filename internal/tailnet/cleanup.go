@@ -0,0 +1,192 @@
+package tailnet
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/client/tailscale"
+
+	"github.com/michaelbeaumont/tailway/pkg"
+)
+
+// handleDeletion removes the machine of a deleted Gateway from the cluster
+// and the tailnet before releasing the Gateway.
+func (ctrlr *GatewayController) handleDeletion(ctx context.Context, gateway *gatewayapi.Gateway) error {
+	hostname := pkg.GatewayHostname(gateway)
+	// the hostname may have changed since the objects were created
+	selector := client.MatchingLabels{gatewayUIDLabel: string(gateway.UID)}
+
+	ctrlr.Logger.Info("deleting node", "name", hostname)
+
+	deployments := appsv1.DeploymentList{}
+	if err := ctrlr.List(ctx, &deployments, client.InNamespace(ctrlr.Namespace), selector); err != nil {
+		return err
+	}
+	for i := range deployments.Items {
+		if err := ctrlr.Delete(ctx, &deployments.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	secrets := v1.SecretList{}
+	if err := ctrlr.List(ctx, &secrets, client.InNamespace(ctrlr.Namespace), selector); err != nil {
+		return err
+	}
+	// only the authkey Secret has the fqdn label
+	var authkeySecret *v1.Secret
+	for i := range secrets.Items {
+		if _, ok := secrets.Items[i].Labels[fqdnLabel]; ok {
+			authkeySecret = &secrets.Items[i]
+		}
+	}
+
+	if err := ctrlr.deleteDevice(ctx, gateway, hostname, authkeySecret); err != nil {
+		// without a valid config we can't reach the tailnet, retrying
+		// wouldn't help and the device has to be removed by hand
+		var invalid invalidConfigError
+		if !errors.As(err, &invalid) {
+			if statusErr := ctrlr.setDeviceDeletedCondition(ctx, gateway, "DeletionFailed", err); statusErr != nil {
+				ctrlr.Logger.Error(statusErr, "couldn't set status")
+			}
+			return err
+		}
+		ctrlr.Logger.Info("config is invalid, not removing device", "name", hostname, "reason", err.Error())
+		if statusErr := ctrlr.setDeviceDeletedCondition(ctx, gateway, "DeletionSkipped", err); statusErr != nil {
+			ctrlr.Logger.Error(statusErr, "couldn't set status")
+		}
+	}
+
+	// state Secrets created by tailscale before we created them don't have
+	// our labels
+	for _, deployment := range deployments.Items {
+		secrets.Items = append(secrets.Items, v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      deployment.Name + "-state",
+				Namespace: deployment.Namespace,
+			},
+		})
+	}
+	for i := range secrets.Items {
+		if err := ctrlr.Delete(ctx, &secrets.Items[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	rbac, err := rbacObjects(ctx, ctrlr.Client, ctrlr.Namespace, selector)
+	if err != nil {
+		return err
+	}
+	for _, obj := range rbac {
+		if err := ctrlr.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	controllerutil.RemoveFinalizer(gateway, gatewayFinalizer)
+	return ctrlr.Update(ctx, gateway)
+}
+
+// deleteDevice removes the machine of gateway from the tailnet, if it's
+// there. The device recorded in authkeySecret is preferred.
+func (ctrlr *GatewayController) deleteDevice(
+	ctx context.Context,
+	gateway *gatewayapi.Gateway,
+	hostname string,
+	authkeySecret *v1.Secret,
+) error {
+	class := &gatewayapi.GatewayClass{}
+	if err := ctrlr.Get(ctx, types.NamespacedName{Name: string(gateway.Spec.GatewayClassName)}, class); err != nil {
+		if api_errors.IsNotFound(err) {
+			ctrlr.Logger.Info("GatewayClass is gone, not removing device", "name", hostname)
+			return nil
+		}
+		return err
+	}
+
+	ts, err := ctrlr.tsClients.forClass(ctx, ctrlr.Client, ctrlr.Namespace, class)
+	if err != nil {
+		return err
+	}
+
+	if authkeySecret != nil && authkeySecret.Annotations[deviceIDAnnotation] != "" {
+		deleted, err := ctrlr.deleteDeviceID(ctx, ts, hostname, authkeySecret.Annotations[deviceIDAnnotation])
+		if err != nil || deleted {
+			return err
+		}
+		ctrlr.Logger.Info("recorded device is gone, looking for the machine's device", "name", hostname)
+	}
+
+	// without a usable recorded ID we fall back to the name the machine
+	// reported or a device with our tags
+	deviceHostname := hostname
+	var tags []string
+	if config, err := configForClass(ctx, ctrlr.Client, ctrlr.Namespace, class); err == nil {
+		deviceHostname = machineHostname(config, hostname)
+		tags = config.Spec.Tags
+	}
+
+	done := apiCall("Devices")
+	devices, err := ts.Devices(ctx, tailscale.DeviceDefaultFields)
+	done(err)
+	if err != nil {
+		return errors.Wrap(err, "couldn't list devices")
+	}
+	device := machineDevice(devices, gateway, deviceHostname, "", tags)
+	if device == nil {
+		ctrlr.Logger.Info("no device of the machine found, not removing any", "name", hostname)
+		return nil
+	}
+
+	_, err = ctrlr.deleteDeviceID(ctx, ts, hostname, device.DeviceID)
+	return err
+}
+
+// deleteDeviceID deletes the device with deviceID of the machine with fqdn.
+// It reports whether the device was still there.
+func (ctrlr *GatewayController) deleteDeviceID(
+	ctx context.Context,
+	ts *tailscale.Client,
+	fqdn, deviceID string,
+) (bool, error) {
+	ctrlr.Logger.Info("deleting device", "name", fqdn, "id", deviceID)
+	done := apiCall("DeleteDevice")
+	err := ts.DeleteDevice(ctx, deviceID)
+	done(err)
+	var response tailscale.ErrResponse
+	if errors.As(err, &response) && response.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't delete device")
+	}
+	return true, nil
+}
+
+func (ctrlr *GatewayController) setDeviceDeletedCondition(
+	ctx context.Context,
+	gateway *gatewayapi.Gateway,
+	reason string,
+	err error,
+) error {
+	orig := gateway.DeepCopyObject().(client.Object)
+
+	meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+		ObservedGeneration: gateway.GetGeneration(),
+		Type:               deviceDeletedCondition,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            err.Error(),
+	})
+
+	return ctrlr.Status().Patch(ctx, gateway, client.MergeFrom(orig))
+}
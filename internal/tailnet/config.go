@@ -0,0 +1,170 @@
+package tailnet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
+)
+
+// invalidConfigError describes why the parametersRef of a GatewayClass can't
+// be used.
+type invalidConfigError string
+
+func (err invalidConfigError) Error() string {
+	return string(err)
+}
+
+// configForClass returns the TailwayConfig class refers to, which has to be in
+// namespace. An invalidConfigError is returned if the reference or the config
+// is invalid.
+func configForClass(
+	ctx context.Context,
+	cl client.Client,
+	namespace string,
+	class *gatewayapi.GatewayClass,
+) (*tailwayapi.TailwayConfig, error) {
+	ref := class.Spec.ParametersRef
+	if ref == nil ||
+		string(ref.Group) != tailwayapi.GroupName ||
+		string(ref.Kind) != tailwayapi.TailwayConfigKind ||
+		ref.Namespace == nil {
+		return nil, invalidConfigError(fmt.Sprintf(
+			"ParametersRef must refer to a namespaced %s.%s", tailwayapi.TailwayConfigKind, tailwayapi.GroupName,
+		))
+	}
+	if string(*ref.Namespace) != namespace {
+		return nil, invalidConfigError(fmt.Sprintf("ParametersRef must refer to tailway's namespace %s", namespace))
+	}
+
+	config := &tailwayapi.TailwayConfig{}
+	if err := cl.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: string(*ref.Namespace)}, config); err != nil {
+		if api_errors.IsNotFound(err) {
+			return nil, invalidConfigError(fmt.Sprintf(
+				"ParametersRef refers to a nonexistent %s %s/%s", tailwayapi.TailwayConfigKind, *ref.Namespace, ref.Name,
+			))
+		}
+		return nil, err
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func validateConfig(config *tailwayapi.TailwayConfig) error {
+	if config.Spec.OAuthSecretRef.Name == "" {
+		return invalidConfigError("spec.oauthSecretRef.name is required")
+	}
+	for _, tag := range config.Spec.Tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return invalidConfigError(fmt.Sprintf("spec.tags: %q must start with tag:", tag))
+		}
+	}
+	if config.Spec.DeleteStaleDevices && len(config.Spec.Tags) == 0 {
+		return invalidConfigError("spec.deleteStaleDevices requires spec.tags to tell our devices apart")
+	}
+	if config.Spec.TailscaleVersion != "" && config.Spec.ProxyImage != "" && imageHasTag(config.Spec.ProxyImage) {
+		return invalidConfigError("spec.proxyImage can't have a tag if spec.tailscaleVersion is set")
+	}
+	if strings.Contains(config.Spec.HostnamePrefix, ".") {
+		return invalidConfigError("spec.hostnamePrefix can't contain dots")
+	}
+	if _, err := patchPodTemplate(v1.PodTemplateSpec{}, config.Spec.PodTemplatePatch); err != nil {
+		return invalidConfigError(err.Error())
+	}
+	return nil
+}
+
+// refersToConfig checks whether class uses config as its parameters.
+func refersToConfig(class *gatewayapi.GatewayClass, config client.Object) bool {
+	ref := class.Spec.ParametersRef
+	return ref != nil &&
+		string(ref.Group) == tailwayapi.GroupName &&
+		string(ref.Kind) == tailwayapi.TailwayConfigKind &&
+		ref.Namespace != nil &&
+		string(*ref.Namespace) == config.GetNamespace() &&
+		ref.Name == config.GetName()
+}
+
+// classesForConfig maps TailwayConfigs to the GatewayClasses referring to
+// them.
+func classesForConfig(logger logr.Logger, cl client.Client) handler.MapFunc {
+	logger = logger.WithName("classesForConfig")
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		classes := &gatewayapi.GatewayClassList{}
+		if err := cl.List(ctx, classes); err != nil {
+			logger.Error(err, "unexpected error listing GatewayClasses")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for i := range classes.Items {
+			if refersToConfig(&classes.Items[i], obj) {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: client.ObjectKeyFromObject(&classes.Items[i]),
+				})
+			}
+		}
+
+		return requests
+	}
+}
+
+// gatewaysForConfig maps TailwayConfigs to the Gateways of the
+// GatewayClasses referring to them.
+func gatewaysForConfig(logger logr.Logger, cl client.Client) handler.MapFunc {
+	logger = logger.WithName("gatewaysForConfig")
+	forClass := gatewaysForClass(logger, cl)
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		classes := &gatewayapi.GatewayClassList{}
+		if err := cl.List(ctx, classes); err != nil {
+			logger.Error(err, "unexpected error listing GatewayClasses")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for i := range classes.Items {
+			if refersToConfig(&classes.Items[i], obj) {
+				requests = append(requests, forClass(ctx, &classes.Items[i])...)
+			}
+		}
+
+		return requests
+	}
+}
+
+// classesForSecret maps OAuth Secrets to the GatewayClasses whose
+// TailwayConfig refers to them.
+func classesForSecret(logger logr.Logger, cl client.Client) handler.MapFunc {
+	logger = logger.WithName("classesForSecret")
+	forConfig := classesForConfig(logger, cl)
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		configs := &tailwayapi.TailwayConfigList{}
+		if err := cl.List(ctx, configs, client.InNamespace(obj.GetNamespace())); err != nil {
+			logger.Error(err, "unexpected error listing TailwayConfigs")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for i := range configs.Items {
+			if configs.Items[i].Spec.OAuthSecretRef.Name == obj.GetName() {
+				requests = append(requests, forConfig(ctx, &configs.Items[i])...)
+			}
+		}
+
+		return requests
+	}
+}
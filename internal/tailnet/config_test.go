@@ -0,0 +1,80 @@
+package tailnet
+
+import (
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
+)
+
+func TestValidateConfig(t *testing.T) {
+	oauth := v1.LocalObjectReference{Name: "oauth"}
+
+	cases := []struct {
+		name        string
+		spec        tailwayapi.TailwayConfigSpec
+		wantInvalid bool
+	}{{
+		name: "minimal",
+		spec: tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth},
+	}, {
+		name:        "missing OAuth Secret",
+		spec:        tailwayapi.TailwayConfigSpec{},
+		wantInvalid: true,
+	}, {
+		name: "tags",
+		spec: tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, Tags: []string{"tag:tailway"}},
+	}, {
+		name:        "tag without prefix",
+		spec:        tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, Tags: []string{"tailway"}},
+		wantInvalid: true,
+	}, {
+		name: "deleting stale devices with tags",
+		spec: tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, Tags: []string{"tag:tailway"}, DeleteStaleDevices: true},
+	}, {
+		name:        "deleting stale devices without tags",
+		spec:        tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, DeleteStaleDevices: true},
+		wantInvalid: true,
+	}, {
+		name: "pinned version",
+		spec: tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, ProxyImage: "registry.local:5000/tailscale", TailscaleVersion: "v1.46.1"},
+	}, {
+		name:        "pinned version with image tag",
+		spec:        tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, ProxyImage: "tailscale/tailscale:stable", TailscaleVersion: "v1.46.1"},
+		wantInvalid: true,
+	}, {
+		name:        "hostname prefix with dots",
+		spec:        tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, HostnamePrefix: "tail.way"},
+		wantInvalid: true,
+	}, {
+		name: "pod template patch",
+		spec: tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, PodTemplatePatch: &runtime.RawExtension{
+			Raw: []byte(`{"spec":{"nodeSelector":{"kubernetes.io/os":"linux"}}}`),
+		}},
+	}, {
+		name: "invalid pod template patch",
+		spec: tailwayapi.TailwayConfigSpec{OAuthSecretRef: oauth, PodTemplatePatch: &runtime.RawExtension{
+			Raw: []byte(`{"spec":`),
+		}},
+		wantInvalid: true,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateConfig(&tailwayapi.TailwayConfig{Spec: tc.spec})
+			var invalid invalidConfigError
+			if tc.wantInvalid {
+				if !errors.As(err, &invalid) {
+					t.Fatalf("got error %v, want invalidConfigError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
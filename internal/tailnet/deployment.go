@@ -2,19 +2,41 @@ package tailnet
 
 import (
 	"context"
+	"encoding/json"
+	"strconv"
 	"strings"
 
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+
+	"github.com/michaelbeaumont/tailway/pkg"
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
 )
 
-func (ctrlr *GatewayController) handleDeployment(ctx context.Context, gateway metav1.Object, fqdn string) error {
+const defaultProxyImage = "ghcr.io/tailscale/tailscale"
+const defaultMachineImage = "michaelbeaumont/tailway:latest"
+
+func (ctrlr *GatewayController) handleDeployment(
+	ctx context.Context,
+	gateway metav1.Object,
+	config *tailwayapi.TailwayConfig,
+	fqdn string,
+	authKeyID string,
+) (*appsv1.Deployment, error) {
 	deployments := appsv1.DeploymentList{}
-	if err := ctrlr.List(ctx, &deployments, client.MatchingLabels{fqdnLabel: fqdn}); err != nil {
-		return err
+	if err := ctrlr.List(ctx, &deployments, client.InNamespace(ctrlr.Namespace), client.MatchingLabels{fqdnLabel: fqdn}); err != nil {
+		return nil, err
 	}
 
 	objectName := strings.ReplaceAll(fqdn, ".", "-")
@@ -22,7 +44,7 @@ func (ctrlr *GatewayController) handleDeployment(ctx context.Context, gateway me
 	deployment := appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      objectName,
-			Namespace: "tailway-system",
+			Namespace: ctrlr.Namespace,
 			Labels: map[string]string{
 				fqdnLabel: fqdn,
 			},
@@ -33,24 +55,174 @@ func (ctrlr *GatewayController) handleDeployment(ctx context.Context, gateway me
 	}
 
 	result, err := controllerutil.CreateOrPatch(ctx, ctrlr.Client, &deployment, func() error {
-		deployment.Spec = makeDeploymentSpec(fqdn, objectName)
+		setGatewayLabels(&deployment, gateway)
+
+		spec := makeDeploymentSpec(gateway, config, fqdn, objectName, authKeyID)
+		template, err := patchPodTemplate(spec.Template, config.Spec.PodTemplatePatch)
+		if err != nil {
+			return err
+		}
+		spec.Template = template
+		deployment.Spec = spec
 
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ctrlr.Logger.Info("handled deployment", "op", result, "name", deployment.Name)
 
-	return nil
+	return &deployment, nil
 }
 
-func makeDeploymentSpec(fqdn, objectName string) appsv1.DeploymentSpec {
-	var replicas int32 = 1
+func deploymentAvailable(deployment *appsv1.Deployment) bool {
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return false
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentAvailable {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// gatewaysForMachineObject maps the Deployments and Secrets of machines to
+// their Gateways. State Secrets created by tailscale only have our naming,
+// not our labels, and older objects only have the fqdn label.
+func gatewaysForMachineObject(logger logr.Logger, cl client.Client, namespace string) handler.MapFunc {
+	logger = logger.WithName("gatewaysForMachineObject")
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		if obj.GetNamespace() != namespace {
+			return nil
+		}
+
+		if gateway, ok := labeledGateway(obj); ok {
+			return []reconcile.Request{{NamespacedName: gateway}}
+		}
+		fqdn, hasLabel := obj.GetLabels()[fqdnLabel]
+		stateOf, isState := strings.CutSuffix(obj.GetName(), "-state")
+		if !hasLabel && !isState {
+			return nil
+		}
+
+		gateways := &gatewayapi.GatewayList{}
+		if err := cl.List(ctx, gateways); err != nil {
+			logger.Error(err, "unexpected error listing Gateways")
+			return nil
+		}
+
+		var requests []reconcile.Request
+		for i := range gateways.Items {
+			hostname := pkg.GatewayHostname(&gateways.Items[i])
+			if hasLabel && hostname == fqdn ||
+				!hasLabel && strings.ReplaceAll(hostname, ".", "-") == stateOf {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: client.ObjectKeyFromObject(&gateways.Items[i]),
+				})
+			}
+		}
+
+		return requests
+	}
+}
 
+// machineHostname returns the tailscale hostname of the machine with fqdn.
+func machineHostname(config *tailwayapi.TailwayConfig, fqdn string) string {
 	parts := strings.SplitN(fqdn, ".", 2)
-	machineName := parts[0]
+	return config.Spec.HostnamePrefix + parts[0]
+}
+
+// proxySecurityContext returns the security context of the tailscale
+// container. Only the kernel networking mode needs NET_ADMIN, otherwise it
+// can run with everything dropped.
+func proxySecurityContext(config *tailwayapi.TailwayConfig) *v1.SecurityContext {
+	if !config.Spec.Node.Userspace {
+		return &v1.SecurityContext{
+			Capabilities: &v1.Capabilities{
+				Add: []v1.Capability{"NET_ADMIN"},
+			},
+		}
+	}
+
+	allowPrivilegeEscalation := false
+	return &v1.SecurityContext{
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &v1.Capabilities{
+			Drop: []v1.Capability{"ALL"},
+		},
+		SeccompProfile: &v1.SeccompProfile{
+			Type: v1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// patchPodTemplate applies the strategic merge patch of a TailwayConfig to
+// template.
+func patchPodTemplate(template v1.PodTemplateSpec, patch *runtime.RawExtension) (v1.PodTemplateSpec, error) {
+	if patch == nil || len(patch.Raw) == 0 {
+		return template, nil
+	}
+
+	original, err := json.Marshal(template)
+	if err != nil {
+		return template, err
+	}
+	patched, err := strategicpatch.StrategicMergePatch(original, patch.Raw, v1.PodTemplateSpec{})
+	if err != nil {
+		return template, errors.Wrap(err, "couldn't apply podTemplatePatch")
+	}
+
+	result := v1.PodTemplateSpec{}
+	if err := json.Unmarshal(patched, &result); err != nil {
+		return template, errors.Wrap(err, "couldn't apply podTemplatePatch")
+	}
+	return result, nil
+}
+
+// proxyImage returns the tailscale image of config, tagged with the pinned
+// version if there is one.
+func proxyImage(config *tailwayapi.TailwayConfig) string {
+	image := config.Spec.ProxyImage
+	if image == "" {
+		image = defaultProxyImage
+	}
+	switch {
+	case config.Spec.TailscaleVersion != "":
+		return image + ":" + config.Spec.TailscaleVersion
+	case !imageHasTag(image):
+		return image + ":latest"
+	default:
+		return image
+	}
+}
+
+// imageHasTag checks whether image has a tag or digest, ignoring the port of
+// a registry.
+func imageHasTag(image string) bool {
+	if strings.Contains(image, "@") {
+		return true
+	}
+	return strings.Contains(image[strings.LastIndex(image, "/")+1:], ":")
+}
+
+func makeDeploymentSpec(
+	gateway metav1.Object,
+	config *tailwayapi.TailwayConfig,
+	fqdn, objectName, authKeyID string,
+) appsv1.DeploymentSpec {
+	var replicas int32 = 1
+
+	machineImage := config.Spec.MachineImage
+	if machineImage == "" {
+		machineImage = defaultMachineImage
+	}
+
+	extraArgs := config.Spec.Node.ExtraArgs
+	if config.Spec.Node.AcceptRoutes {
+		extraArgs = append([]string{"--accept-routes"}, extraArgs...)
+	}
 
 	return appsv1.DeploymentSpec{
 		Replicas: &replicas,
@@ -64,27 +236,51 @@ func makeDeploymentSpec(fqdn, objectName string) appsv1.DeploymentSpec {
 				Labels: map[string]string{
 					fqdnLabel: fqdn,
 				},
+				// tailscale only reads the authkey on startup, this
+				// restarts the machine when it gets a new one
+				Annotations: map[string]string{
+					authKeyIDAnnotation: authKeyID,
+				},
 			},
 			Spec: v1.PodSpec{
-				ServiceAccountName: "tailway",
+				ServiceAccountName: objectName,
+				ImagePullSecrets:   config.Spec.ImagePullSecrets,
 				Containers: []v1.Container{
 					{
 						Name:            "tailway",
-						Image:           "michaelbeaumont/tailway:latest",
-						ImagePullPolicy: v1.PullNever,
+						Image:           machineImage,
+						ImagePullPolicy: config.Spec.MachineImagePullPolicy,
 						VolumeMounts: []v1.VolumeMount{{
 							MountPath: "/var/run/tailscale",
 							Name:      "var-run-tailscale",
 						}},
 						Args: []string{"machine"},
+						// only ready once tailscale is running
+						ReadinessProbe: &v1.Probe{
+							ProbeHandler: v1.ProbeHandler{
+								HTTPGet: &v1.HTTPGetAction{Path: "/readyz", Port: intstr.FromInt(pkg.HealthProbePort)},
+							},
+						},
+						LivenessProbe: &v1.Probe{
+							ProbeHandler: v1.ProbeHandler{
+								HTTPGet: &v1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(pkg.HealthProbePort)},
+							},
+						},
+						Env: []v1.EnvVar{
+							{Name: pkg.GatewayNamespaceEnv, Value: gateway.GetNamespace()},
+							{Name: pkg.GatewayNameEnv, Value: gateway.GetName()},
+						},
 					},
 					{
-						Name:  "tailscale",
-						Image: "ghcr.io/tailscale/tailscale:latest",
+						Name:            "tailscale",
+						Image:           proxyImage(config),
+						ImagePullPolicy: config.Spec.ProxyImagePullPolicy,
 						Env: []v1.EnvVar{
 							{Name: "TS_KUBE_SECRET", Value: objectName + "-state"},
-							{Name: "TS_USERSPACE", Value: "false"},
-							{Name: "TS_HOSTNAME", Value: machineName},
+							{Name: "TS_USERSPACE", Value: strconv.FormatBool(config.Spec.Node.Userspace)},
+							{Name: "TS_HOSTNAME", Value: machineHostname(config, fqdn)},
+							{Name: "TS_ACCEPT_DNS", Value: strconv.FormatBool(config.Spec.Node.AcceptDNS)},
+							{Name: "TS_EXTRA_ARGS", Value: strings.Join(extraArgs, " ")},
 							{Name: "TS_SOCKET", Value: "/var/run/tailscale/tailscaled.sock"},
 							{Name: "TS_AUTH_ONCE", Value: "true"},
 							{Name: "TS_AUTHKEY", ValueFrom: &v1.EnvVarSource{
@@ -96,15 +292,12 @@ func makeDeploymentSpec(fqdn, objectName string) appsv1.DeploymentSpec {
 								},
 							}},
 						},
+						Resources: config.Spec.Resources,
 						VolumeMounts: []v1.VolumeMount{{
 							MountPath: "/var/run/tailscale",
 							Name:      "var-run-tailscale",
 						}},
-						SecurityContext: &v1.SecurityContext{
-							Capabilities: &v1.Capabilities{
-								Add: []v1.Capability{"NET_ADMIN"},
-							},
-						},
+						SecurityContext: proxySecurityContext(config),
 					},
 				},
 				Volumes: []v1.Volume{{
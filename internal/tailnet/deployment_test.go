@@ -0,0 +1,130 @@
+package tailnet
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
+)
+
+func TestProxyImage(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    tailwayapi.TailwayConfigSpec
+		want    string
+		wantTag bool
+	}{{
+		name: "default",
+		want: "ghcr.io/tailscale/tailscale:latest",
+	}, {
+		name: "pinned version",
+		spec: tailwayapi.TailwayConfigSpec{TailscaleVersion: "v1.46.1"},
+		want: "ghcr.io/tailscale/tailscale:v1.46.1",
+	}, {
+		name:    "image with tag",
+		spec:    tailwayapi.TailwayConfigSpec{ProxyImage: "tailscale/tailscale:stable"},
+		want:    "tailscale/tailscale:stable",
+		wantTag: true,
+	}, {
+		name:    "image with digest",
+		spec:    tailwayapi.TailwayConfigSpec{ProxyImage: "tailscale/tailscale@sha256:0123"},
+		want:    "tailscale/tailscale@sha256:0123",
+		wantTag: true,
+	}, {
+		name: "registry with port",
+		spec: tailwayapi.TailwayConfigSpec{ProxyImage: "registry.local:5000/tailscale"},
+		want: "registry.local:5000/tailscale:latest",
+	}, {
+		name:    "registry with port and tag",
+		spec:    tailwayapi.TailwayConfigSpec{ProxyImage: "registry.local:5000/tailscale:stable"},
+		want:    "registry.local:5000/tailscale:stable",
+		wantTag: true,
+	}, {
+		name: "registry with port and pinned version",
+		spec: tailwayapi.TailwayConfigSpec{ProxyImage: "registry.local:5000/tailscale", TailscaleVersion: "v1.46.1"},
+		want: "registry.local:5000/tailscale:v1.46.1",
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.spec.ProxyImage != "" {
+				if got := imageHasTag(tc.spec.ProxyImage); got != tc.wantTag {
+					t.Errorf("imageHasTag: got %t, want %t", got, tc.wantTag)
+				}
+			}
+			if got := proxyImage(&tailwayapi.TailwayConfig{Spec: tc.spec}); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPatchPodTemplate(t *testing.T) {
+	template := v1.PodTemplateSpec{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "tailscale", Image: "tailscale"},
+				{Name: "machine", Image: "machine"},
+			},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		patch   *runtime.RawExtension
+		want    v1.PodTemplateSpec
+		wantErr bool
+	}{{
+		name: "no patch",
+		want: template,
+	}, {
+		name:  "empty patch",
+		patch: &runtime.RawExtension{},
+		want:  template,
+	}, {
+		name:  "node selector",
+		patch: &runtime.RawExtension{Raw: []byte(`{"spec":{"nodeSelector":{"kubernetes.io/os":"linux"}}}`)},
+		want: v1.PodTemplateSpec{
+			Spec: v1.PodSpec{
+				Containers:   template.Spec.Containers,
+				NodeSelector: map[string]string{"kubernetes.io/os": "linux"},
+			},
+		},
+	}, {
+		name:  "containers are merged by name",
+		patch: &runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"machine","image":"patched"}]}}`)},
+		want: v1.PodTemplateSpec{
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{Name: "tailscale", Image: "tailscale"},
+					{Name: "machine", Image: "patched"},
+				},
+			},
+		},
+	}, {
+		name:    "invalid patch",
+		patch:   &runtime.RawExtension{Raw: []byte(`{"spec":`)},
+		wantErr: true,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchPodTemplate(template, tc.patch)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
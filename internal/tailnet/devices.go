@@ -0,0 +1,234 @@
+package tailnet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/client/tailscale"
+
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
+)
+
+const conflictedCondition = "Conflicted"
+
+// staleDeviceAge is how long a device has to be offline before it's
+// considered stale.
+const staleDeviceAge = 5 * time.Minute
+
+// conflictRecheck is how often devices are checked again while a Gateway is
+// conflicted, devices don't trigger reconciliation.
+const conflictRecheck = time.Minute
+
+// deviceList lists the devices of a tailnet at most once, so that a
+// reconciliation doesn't call the API repeatedly.
+type deviceList struct {
+	ts      *tailscale.Client
+	devices []*tailscale.Device
+	listed  bool
+}
+
+func (list *deviceList) get(ctx context.Context) ([]*tailscale.Device, error) {
+	if list.listed {
+		return list.devices, nil
+	}
+	done := apiCall("Devices")
+	devices, err := list.ts.Devices(ctx, tailscale.DeviceDefaultFields)
+	done(err)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't list devices")
+	}
+	list.devices, list.listed = devices, true
+	return devices, nil
+}
+
+// handleDevices checks whether other devices hold the hostname of the machine
+// of gateway, which makes tailscale give the machine a suffixed name. If
+// config allows it, offline devices with our tags are deleted. It returns the
+// Conflicted condition of the Gateway. The device of the machine is recorded
+// in its authkey Secret.
+func (ctrlr *GatewayController) handleDevices(
+	ctx context.Context,
+	list *deviceList,
+	gateway *gatewayapi.Gateway,
+	config *tailwayapi.TailwayConfig,
+	fqdn string,
+) (metav1.Condition, error) {
+	hostname := machineHostname(config, fqdn)
+
+	conflicted := metav1.Condition{
+		ObservedGeneration: gateway.GetGeneration(),
+		Type:               conflictedCondition,
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoConflicts",
+	}
+
+	authkeySecret, err := ctrlr.authKeySecret(ctx, fqdn)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+	var deviceID string
+	if authkeySecret != nil {
+		deviceID = authkeySecret.Annotations[deviceIDAnnotation]
+	}
+
+	// the recorded device is only a hint, the machine may have logged in
+	// again since
+	devices, err := list.get(ctx)
+	if err != nil {
+		return metav1.Condition{}, err
+	}
+
+	current := machineDevice(devices, gateway, hostname, deviceID, config.Spec.Tags)
+	if current != nil && authkeySecret != nil && current.DeviceID != deviceID {
+		if err := ctrlr.recordDeviceID(ctx, authkeySecret, current.DeviceID); err != nil {
+			return metav1.Condition{}, err
+		}
+	}
+
+	var conflicts []string
+	for _, device := range devices {
+		if device == current ||
+			device.Hostname != hostname && !strings.EqualFold(dnsLabel(device.Name), hostname) {
+			continue
+		}
+		if config.Spec.DeleteStaleDevices && staleDevice(device, config.Spec.Tags) {
+			ctrlr.Logger.Info("deleting stale device", "name", device.Name, "id", device.DeviceID)
+			done := apiCall("DeleteDevice")
+			err := list.ts.DeleteDevice(ctx, device.DeviceID)
+			done(err)
+			if err != nil {
+				return metav1.Condition{}, errors.Wrap(err, "couldn't delete device")
+			}
+			continue
+		}
+		conflicts = append(conflicts, strings.TrimSuffix(device.Name, "."))
+	}
+
+	switch {
+	case current != nil && !strings.EqualFold(dnsLabel(current.Name), hostname):
+		conflicted.Status = metav1.ConditionTrue
+		conflicted.Reason = "HostnameConflict"
+		conflicted.Message = fmt.Sprintf(
+			"machine got the name %s instead of %s, delete the devices holding it and the machine's device",
+			strings.TrimSuffix(current.Name, "."), hostname,
+		)
+	case len(conflicts) > 0:
+		conflicted.Status = metav1.ConditionTrue
+		conflicted.Reason = "HostnameConflict"
+		conflicted.Message = fmt.Sprintf("hostname %s is also used by %s", hostname, strings.Join(conflicts, ", "))
+	}
+
+	return conflicted, nil
+}
+
+// machineDevice returns the device of the machine of gateway. The DNS name
+// the machine reported in the Gateway status is preferred over the recorded
+// deviceID. Otherwise it's the newest device with hostname, but only if it has
+// tags, so that devices that aren't ours are never picked.
+func machineDevice(
+	devices []*tailscale.Device,
+	gateway *gatewayapi.Gateway,
+	hostname, deviceID string,
+	tags []string,
+) *tailscale.Device {
+	if name := reportedName(gateway); name != "" {
+		for _, device := range devices {
+			if strings.TrimSuffix(device.Name, ".") == name {
+				return device
+			}
+		}
+	}
+
+	if deviceID != "" {
+		for _, device := range devices {
+			if device.DeviceID == deviceID {
+				return device
+			}
+		}
+	}
+
+	var newest *tailscale.Device
+	for _, device := range devices {
+		if device.Hostname == hostname && hasTags(device, tags) && (newest == nil || device.Created > newest.Created) {
+			newest = device
+		}
+	}
+	return newest
+}
+
+// staleDevice checks whether device has all of tags and hasn't been seen for
+// a while. Without tags no device is stale, it could be anybody's.
+func staleDevice(device *tailscale.Device, tags []string) bool {
+	if !hasTags(device, tags) {
+		return false
+	}
+	lastSeen, err := time.Parse(time.RFC3339, device.LastSeen)
+	return err == nil && time.Since(lastSeen) > staleDeviceAge
+}
+
+// reportedName returns the DNS name the machine reported in the status of
+// gateway, if any.
+func reportedName(gateway *gatewayapi.Gateway) string {
+	for _, address := range gateway.Status.Addresses {
+		if address.Type != nil && *address.Type == gatewayapi.HostnameAddressType {
+			return address.Value
+		}
+	}
+	return ""
+}
+
+// hasTags checks whether device has all of tags, which must not be empty.
+func hasTags(device *tailscale.Device, tags []string) bool {
+	if len(tags) == 0 {
+		return false
+	}
+	for _, tag := range tags {
+		found := false
+		for _, deviceTag := range device.Tags {
+			found = found || deviceTag == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// authKeySecret returns the authkey Secret of the machine with fqdn, if
+// there is one.
+func (ctrlr *GatewayController) authKeySecret(ctx context.Context, fqdn string) (*v1.Secret, error) {
+	secrets := v1.SecretList{}
+	if err := ctrlr.List(ctx, &secrets, client.InNamespace(ctrlr.Namespace), client.MatchingLabels{
+		fqdnLabel: fqdn,
+	}); err != nil {
+		return nil, err
+	}
+	if len(secrets.Items) == 0 {
+		return nil, nil
+	}
+	return &secrets.Items[0], nil
+}
+
+// recordDeviceID remembers the device of the machine in its authkey Secret,
+// it's the only device removed from the tailnet with the machine.
+func (ctrlr *GatewayController) recordDeviceID(ctx context.Context, authkeySecret *v1.Secret, deviceID string) error {
+	orig := authkeySecret.DeepCopy()
+	if authkeySecret.Annotations == nil {
+		authkeySecret.Annotations = map[string]string{}
+	}
+	authkeySecret.Annotations[deviceIDAnnotation] = deviceID
+	return ctrlr.Patch(ctx, authkeySecret, client.MergeFrom(orig))
+}
+
+// dnsLabel returns the first label of the MagicDNS name of a device.
+func dnsLabel(name string) string {
+	label, _, _ := strings.Cut(name, ".")
+	return label
+}
@@ -0,0 +1,142 @@
+package tailnet
+
+import (
+	"testing"
+	"time"
+
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/client/tailscale"
+)
+
+// reportingGateway returns a Gateway whose machine reported name.
+func reportingGateway(name string) *gatewayapi.Gateway {
+	hostnameType := gatewayapi.HostnameAddressType
+	return &gatewayapi.Gateway{
+		Status: gatewayapi.GatewayStatus{
+			Addresses: []gatewayapi.GatewayAddress{{Type: &hostnameType, Value: name}},
+		},
+	}
+}
+
+// namedDevice returns a device of a machine with the hostname machine, which
+// tailscale gave name.
+func namedDevice(id, name string, created time.Time, tags ...string) *tailscale.Device {
+	device := testDevice(id, "machine", created)
+	device.Name = name + "."
+	device.Tags = tags
+	return device
+}
+
+func TestMachineDevice(t *testing.T) {
+	now := time.Now()
+	older := namedDevice("older", "machine.example.ts.net", now.Add(-time.Hour), "tag:tailway")
+	newer := namedDevice("newer", "machine-1.example.ts.net", now, "tag:tailway")
+	untagged := namedDevice("untagged", "machine-2.example.ts.net", now.Add(time.Hour))
+	devices := []*tailscale.Device{older, newer, untagged}
+
+	cases := []struct {
+		name     string
+		gateway  *gatewayapi.Gateway
+		devices  []*tailscale.Device
+		deviceID string
+		tags     []string
+		want     *tailscale.Device
+	}{{
+		name:    "reported name",
+		gateway: reportingGateway("machine-1.example.ts.net"),
+		devices: devices,
+		want:    newer,
+	}, {
+		name:     "reported name before recorded ID",
+		gateway:  reportingGateway("machine-1.example.ts.net"),
+		devices:  devices,
+		deviceID: "older",
+		want:     newer,
+	}, {
+		name:     "recorded ID",
+		gateway:  &gatewayapi.Gateway{},
+		devices:  devices,
+		deviceID: "older",
+		want:     older,
+	}, {
+		name:     "stale recorded ID",
+		gateway:  &gatewayapi.Gateway{},
+		devices:  devices,
+		deviceID: "deleted",
+		tags:     []string{"tag:tailway"},
+		want:     newer,
+	}, {
+		name:    "newest tagged device",
+		gateway: &gatewayapi.Gateway{},
+		devices: devices,
+		tags:    []string{"tag:tailway"},
+		want:    newer,
+	}, {
+		name:    "missing tag",
+		gateway: &gatewayapi.Gateway{},
+		devices: devices,
+		tags:    []string{"tag:tailway", "tag:other"},
+	}, {
+		name:    "untagged devices are never picked",
+		gateway: &gatewayapi.Gateway{},
+		devices: []*tailscale.Device{untagged},
+	}, {
+		name:    "unknown reported name",
+		gateway: reportingGateway("other.example.ts.net"),
+		devices: devices,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := machineDevice(tc.devices, tc.gateway, "machine", tc.deviceID, tc.tags)
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStaleDevice(t *testing.T) {
+	seen := func(device *tailscale.Device, ago time.Duration) *tailscale.Device {
+		device.LastSeen = time.Now().Add(-ago).Format(time.RFC3339)
+		return device
+	}
+
+	cases := []struct {
+		name   string
+		device *tailscale.Device
+		tags   []string
+		want   bool
+	}{{
+		name:   "offline with tags",
+		device: seen(&tailscale.Device{Tags: []string{"tag:tailway"}}, time.Hour),
+		tags:   []string{"tag:tailway"},
+		want:   true,
+	}, {
+		name:   "recently seen",
+		device: seen(&tailscale.Device{Tags: []string{"tag:tailway"}}, time.Minute),
+		tags:   []string{"tag:tailway"},
+	}, {
+		name:   "missing a tag",
+		device: seen(&tailscale.Device{Tags: []string{"tag:tailway"}}, time.Hour),
+		tags:   []string{"tag:tailway", "tag:other"},
+	}, {
+		name:   "untagged without tags configured",
+		device: seen(&tailscale.Device{}, time.Hour),
+	}, {
+		name:   "tagged without tags configured",
+		device: seen(&tailscale.Device{Tags: []string{"tag:tailway"}}, time.Hour),
+	}, {
+		name:   "never seen",
+		device: &tailscale.Device{Tags: []string{"tag:tailway"}},
+		tags:   []string{"tag:tailway"},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := staleDevice(tc.device, tc.tags); got != tc.want {
+				t.Errorf("got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
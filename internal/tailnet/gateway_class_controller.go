@@ -2,12 +2,14 @@ package tailnet
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/go-logr/logr"
 	"github.com/michaelbeaumont/tailway/pkg"
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2/clientcredentials"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -20,7 +22,9 @@ import (
 
 type GatewayClassController struct {
 	client.Client
-	Logger    logr.Logger
+	Logger logr.Logger
+	// Namespace is where the TailwayConfigs have to be
+	Namespace string
 	tsClients *TSClients
 }
 
@@ -69,13 +73,27 @@ func gatewaysForClass(logger logr.Logger, cl client.Client) handler.MapFunc {
 	}
 }
 
-func (ctrlr *GatewayClassController) clientFromSecret(ctx context.Context, name types.NamespacedName) (*tailscale.Client, bool, error) {
+// clientFromSecret creates a client for tailnet from the OAuth credentials in
+// the Secret name. An invalidConfigError is returned if the Secret is missing
+// or incomplete.
+func clientFromSecret(
+	ctx context.Context,
+	cl client.Client,
+	name types.NamespacedName,
+	tailnet string,
+) (*tailscale.Client, error) {
 	secret := v1.Secret{}
-	if err := ctrlr.Get(ctx, name, &secret); err != nil {
-		if errors.IsNotFound(err) {
-			return nil, false, nil
+	if err := cl.Get(ctx, name, &secret); err != nil {
+		if api_errors.IsNotFound(err) {
+			return nil, invalidConfigError(fmt.Sprintf("OAuth Secret %s doesn't exist", name))
+		}
+		return nil, err
+	}
+
+	for _, key := range []string{"client_id", "client_secret"} {
+		if len(secret.Data[key]) == 0 {
+			return nil, invalidConfigError(fmt.Sprintf("OAuth Secret %s is missing %s", name, key))
 		}
-		return nil, false, err
 	}
 
 	oauthCredentials := clientcredentials.Config{
@@ -84,17 +102,20 @@ func (ctrlr *GatewayClassController) clientFromSecret(ctx context.Context, name
 		TokenURL:     tokenURL,
 		Scopes:       []string{"devices"},
 	}
-	ts := tailscale.NewClient("-", nil)
+	if tailnet == "" {
+		tailnet = "-"
+	}
+	ts := tailscale.NewClient(tailnet, nil)
 	ts.HTTPClient = oauthCredentials.Client(context.Background())
 
-	return ts, true, nil
+	return ts, nil
 }
 
 func (ctrlr *GatewayClassController) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
 	gatewayClass := &gatewayapi.GatewayClass{}
 	err := ctrlr.Get(ctx, req.NamespacedName, gatewayClass)
 	if err != nil {
-		return reconcile.Result{}, err
+		return reconcile.Result{}, client.IgnoreNotFound(err)
 	}
 
 	if gatewayClass.Spec.ControllerName != pkg.ControllerName {
@@ -104,39 +125,28 @@ func (ctrlr *GatewayClassController) Reconcile(ctx context.Context, req reconcil
 	accepted := metav1.Condition{
 		ObservedGeneration: gatewayClass.GetGeneration(),
 		Type:               string(gatewayapi.GatewayClassConditionStatusAccepted),
+		Status:             metav1.ConditionTrue,
+		Reason:             string(gatewayapi.GatewayClassReasonAccepted),
 	}
 	orig := gatewayClass.DeepCopyObject().(client.Object)
-	ref := gatewayClass.Spec.ParametersRef
+
+	var invalid invalidConfigError
+	ts, err := clientForClass(ctx, ctrlr.Client, ctrlr.Namespace, gatewayClass)
 	switch {
-	case ref != nil &&
-		ref.Kind == "Secret" &&
-		ref.Group == "" &&
-		ref.Namespace != nil &&
-		*ref.Namespace == "tailway-system":
-
-		client, found, err := ctrlr.clientFromSecret(
-			ctx,
-			types.NamespacedName{Name: ref.Name, Namespace: string(*ref.Namespace)},
-		)
-		if err != nil {
-			return reconcile.Result{}, err
-		}
-		if !found {
-			accepted.Status = metav1.ConditionFalse
-			accepted.Reason = string(gatewayapi.GatewayClassReasonInvalidParameters)
-			accepted.Message = "ParametersRef refers to a nonexistent Secret"
-		} else {
-			accepted.Status = metav1.ConditionTrue
-			accepted.Reason = string(gatewayapi.GatewayClassReasonAccepted)
-
-			ctrlr.tsClients.Lock()
-			ctrlr.tsClients.clients[gatewayClass.Name] = client
-			ctrlr.tsClients.Unlock()
-		}
-	default:
+	case errors.As(err, &invalid):
 		accepted.Status = metav1.ConditionFalse
 		accepted.Reason = string(gatewayapi.GatewayClassReasonInvalidParameters)
-		accepted.Message = "ParametersRef must be a Secret in tailway's namespace"
+		accepted.Message = err.Error()
+
+		ctrlr.tsClients.Lock()
+		delete(ctrlr.tsClients.clients, gatewayClass.Name)
+		ctrlr.tsClients.Unlock()
+	case err != nil:
+		return reconcile.Result{}, err
+	default:
+		ctrlr.tsClients.Lock()
+		ctrlr.tsClients.clients[gatewayClass.Name] = ts
+		ctrlr.tsClients.Unlock()
 	}
 
 	meta.SetStatusCondition(&gatewayClass.Status.Conditions, accepted)
@@ -146,3 +156,24 @@ func (ctrlr *GatewayClassController) Reconcile(ctx context.Context, req reconcil
 
 	return reconcile.Result{}, nil
 }
+
+// clientForClass creates a client from the TailwayConfig of class, which
+// has to be in namespace.
+func clientForClass(
+	ctx context.Context,
+	cl client.Client,
+	namespace string,
+	class *gatewayapi.GatewayClass,
+) (*tailscale.Client, error) {
+	config, err := configForClass(ctx, cl, namespace, class)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientFromSecret(
+		ctx,
+		cl,
+		types.NamespacedName{Name: config.Spec.OAuthSecretRef.Name, Namespace: config.Namespace},
+		config.Spec.Tailnet,
+	)
+}
@@ -3,12 +3,20 @@ package tailnet
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"strings"
 
 	"github.com/go-logr/logr"
-	"k8s.io/apimachinery/pkg/api/errors"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
 
@@ -17,7 +25,9 @@ import (
 
 type GatewayController struct {
 	client.Client
-	Logger    logr.Logger
+	Logger logr.Logger
+	// Namespace is where the machines are created
+	Namespace string
 	tsClients *TSClients
 }
 
@@ -25,13 +35,20 @@ func (ctrlr *GatewayController) Reconcile(ctx context.Context, req reconcile.Req
 	gateway := &gatewayapi.Gateway{}
 	err := ctrlr.Get(ctx, req.NamespacedName, gateway)
 	if err != nil {
-		return reconcile.Result{}, err
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !gateway.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(gateway, gatewayFinalizer) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, ctrlr.handleDeletion(ctx, gateway)
 	}
 
 	ctrlr.Logger.Info("checking GatewayClass of parent Gateway", "name", gateway.Spec.GatewayClassName)
 	class := &gatewayapi.GatewayClass{}
 	if err := ctrlr.Get(ctx, types.NamespacedName{Name: string(gateway.Spec.GatewayClassName)}, class); err != nil {
-		if errors.IsNotFound(err) {
+		if api_errors.IsNotFound(err) {
 			return reconcile.Result{}, nil
 		}
 		return reconcile.Result{}, err
@@ -41,22 +58,142 @@ func (ctrlr *GatewayController) Reconcile(ctx context.Context, req reconcile.Req
 		return reconcile.Result{}, nil
 	}
 
-	hostname := fmt.Sprintf("%s-%s", gateway.Name, gateway.Namespace)
-	for _, address := range gateway.Spec.Addresses {
-		if *address.Type == gatewayapi.HostnameAddressType {
-			hostname = address.Value
+	config, err := configForClass(ctx, ctrlr.Client, ctrlr.Namespace, class)
+	if err != nil {
+		// the GatewayClass reports invalid configs
+		var invalid invalidConfigError
+		if errors.As(err, &invalid) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+
+	if controllerutil.AddFinalizer(gateway, gatewayFinalizer) {
+		if err := ctrlr.Update(ctx, gateway); err != nil {
+			return reconcile.Result{}, err
 		}
 	}
 
+	hostname := pkg.GatewayHostname(gateway)
+
 	ctrlr.Logger.Info("creating node", "name", hostname)
 
-	if err := ctrlr.handleSecret(ctx, gateway, class, hostname); err != nil {
+	ts, err := ctrlr.tsClients.forClass(ctx, ctrlr.Client, ctrlr.Namespace, class)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	devices := &deviceList{ts: ts}
+	authKeyID, recheckAuthKey, err := ctrlr.handleSecret(ctx, devices, gateway, config, hostname)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	conflicted, err := ctrlr.handleDevices(ctx, devices, gateway, config, hostname)
+	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	if err := ctrlr.handleDeployment(ctx, gateway, hostname); err != nil {
+	if err := ctrlr.handleRBAC(ctx, gateway, hostname, strings.ReplaceAll(hostname, ".", "-")); err != nil {
 		return reconcile.Result{}, err
 	}
 
-	return reconcile.Result{}, nil
+	deployment, err := ctrlr.handleDeployment(ctx, gateway, config, hostname, authKeyID)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if err := ctrlr.setStatus(ctx, gateway, deployment, conflicted); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	recheck := recheckAuthKey
+	if conflicted.Status == metav1.ConditionTrue && (recheck == 0 || recheck > conflictRecheck) {
+		recheck = conflictRecheck
+	}
+
+	return reconcile.Result{RequeueAfter: recheck}, nil
+}
+
+// machineReportChanged lets through the Gateway updates besides spec changes
+// that matter to us, deletion and what the machine reports about itself.
+// Status patches of our own are ignored, they would trigger listing devices
+// all the time.
+func machineReportChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldGateway, ok := e.ObjectOld.(*gatewayapi.Gateway)
+			if !ok {
+				return true
+			}
+			newGateway, ok := e.ObjectNew.(*gatewayapi.Gateway)
+			if !ok {
+				return true
+			}
+			programmed := func(gateway *gatewayapi.Gateway) bool {
+				return meta.IsStatusConditionTrue(gateway.Status.Conditions, string(gatewayapi.GatewayConditionProgrammed))
+			}
+			// a machine that isn't programmed yet may report it needs to log in
+			reportedState := func(gateway *gatewayapi.Gateway) string {
+				condition := meta.FindStatusCondition(gateway.Status.Conditions, string(gatewayapi.GatewayConditionProgrammed))
+				if condition == nil {
+					return ""
+				}
+				state, _ := pkg.ReportedBackendState(condition.Message)
+				return state
+			}
+			return !oldGateway.DeletionTimestamp.Equal(newGateway.DeletionTimestamp) ||
+				!reflect.DeepEqual(oldGateway.Status.Addresses, newGateway.Status.Addresses) ||
+				programmed(oldGateway) != programmed(newGateway) ||
+				reportedState(oldGateway) != reportedState(newGateway)
+		},
+	}
+}
+
+// setStatus reports the Gateway as accepted but not programmed while its
+// machine isn't up. The machine reports why it isn't programmed in more
+// detail, which isn't overwritten. Once the Deployment is available, it's up
+// to the machine to report itself as programmed after joining the tailnet.
+func (ctrlr *GatewayController) setStatus(
+	ctx context.Context,
+	gateway *gatewayapi.Gateway,
+	deployment *appsv1.Deployment,
+	conflicted metav1.Condition,
+) error {
+	orig := gateway.DeepCopyObject().(client.Object)
+
+	meta.SetStatusCondition(&gateway.Status.Conditions, conflicted)
+
+	meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+		ObservedGeneration: gateway.GetGeneration(),
+		Type:               string(gatewayapi.GatewayConditionAccepted),
+		Status:             metav1.ConditionTrue,
+		Reason:             string(gatewayapi.GatewayReasonAccepted),
+	})
+
+	programmed := meta.FindStatusCondition(gateway.Status.Conditions, string(gatewayapi.GatewayConditionProgrammed))
+	switch {
+	case !deploymentAvailable(deployment) && (programmed == nil || programmed.Status == metav1.ConditionTrue):
+		meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+			ObservedGeneration: gateway.GetGeneration(),
+			Type:               string(gatewayapi.GatewayConditionProgrammed),
+			Status:             metav1.ConditionFalse,
+			Reason:             string(gatewayapi.GatewayReasonPending),
+			Message:            fmt.Sprintf("Deployment %s/%s isn't available yet", deployment.Namespace, deployment.Name),
+		})
+	case programmed == nil:
+		meta.SetStatusCondition(&gateway.Status.Conditions, metav1.Condition{
+			ObservedGeneration: gateway.GetGeneration(),
+			Type:               string(gatewayapi.GatewayConditionProgrammed),
+			Status:             metav1.ConditionFalse,
+			Reason:             string(gatewayapi.GatewayReasonPending),
+			Message:            "waiting for the machine to join the tailnet",
+		})
+	}
+
+	if reflect.DeepEqual(orig.(*gatewayapi.Gateway).Status, gateway.Status) {
+		return nil
+	}
+
+	// the machine patches the same conditions
+	return ctrlr.Status().Patch(ctx, gateway, client.MergeFromWithOptions(orig, client.MergeFromWithOptimisticLock{}))
 }
@@ -0,0 +1,83 @@
+package tailnet
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+var (
+	apiCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tailway_tailscale_api_calls_total",
+		Help: "Calls to the Tailscale API by operation and result.",
+	}, []string{"operation", "result"})
+	apiCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "tailway_tailscale_api_call_duration_seconds",
+		Help: "Latency of calls to the Tailscale API by operation.",
+	}, []string{"operation"})
+	machinesDesc = prometheus.NewDesc(
+		"tailway_machines",
+		"Gateways with a machine by GatewayClass.",
+		[]string{"gateway_class"}, nil,
+	)
+)
+
+// registerMetrics registers the metrics of the tailnet controller, cl is
+// used to count machines.
+func registerMetrics(cl client.Client) error {
+	for _, collector := range []prometheus.Collector{apiCalls, apiCallDuration, &machineCollector{Client: cl}} {
+		if err := metrics.Registry.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiCall starts timing a call to the Tailscale API, the returned function
+// records its result.
+func apiCall(operation string) func(error) {
+	start := time.Now()
+	return func(err error) {
+		apiCallDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		apiCalls.WithLabelValues(operation, result).Inc()
+	}
+}
+
+// machineCollector counts the Gateways we created machines for when
+// scraped.
+type machineCollector struct {
+	client.Client
+}
+
+func (collector *machineCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- machinesDesc
+}
+
+func (collector *machineCollector) Collect(metrics chan<- prometheus.Metric) {
+	gateways := gatewayapi.GatewayList{}
+	// fails until the cache is started
+	if err := collector.List(context.Background(), &gateways); err != nil {
+		return
+	}
+
+	machines := map[gatewayapi.ObjectName]int{}
+	for i := range gateways.Items {
+		gateway := &gateways.Items[i]
+		if controllerutil.ContainsFinalizer(gateway, gatewayFinalizer) {
+			machines[gateway.Spec.GatewayClassName]++
+		}
+	}
+
+	for class, count := range machines {
+		metrics <- prometheus.MustNewConstMetric(machinesDesc, prometheus.GaugeValue, float64(count), string(class))
+	}
+}
@@ -0,0 +1,146 @@
+package tailnet
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
+// Gateways and the objects of their machines are in different namespaces,
+// so instead of owner references the objects are labeled with their
+// Gateway.
+const (
+	gatewayNamespaceLabel = "tailway.michaelbeaumont.github.io/gateway-namespace"
+	gatewayNameLabel      = "tailway.michaelbeaumont.github.io/gateway-name"
+	gatewayUIDLabel       = "tailway.michaelbeaumont.github.io/gateway-uid"
+)
+
+// setGatewayLabels labels obj with gateway and reports whether that changed
+// anything.
+func setGatewayLabels(obj metav1.Object, gateway metav1.Object) bool {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	changed := false
+	for key, value := range map[string]string{
+		gatewayNamespaceLabel: gateway.GetNamespace(),
+		gatewayNameLabel:      gateway.GetName(),
+		gatewayUIDLabel:       string(gateway.GetUID()),
+	} {
+		if labels[key] != value {
+			labels[key] = value
+			changed = true
+		}
+	}
+	obj.SetLabels(labels)
+	return changed
+}
+
+// labeledGateway returns the Gateway obj is labeled with, if any.
+func labeledGateway(obj metav1.Object) (types.NamespacedName, bool) {
+	labels := obj.GetLabels()
+	name := types.NamespacedName{
+		Namespace: labels[gatewayNamespaceLabel],
+		Name:      labels[gatewayNameLabel],
+	}
+	return name, name.Namespace != "" && name.Name != ""
+}
+
+// orphanSweeper periodically deletes the objects of machines whose Gateway
+// is gone without having been cleaned up, e.g. because its finalizer was
+// removed by hand.
+type orphanSweeper struct {
+	client.Client
+	Logger    logr.Logger
+	Namespace string
+	Interval  time.Duration
+}
+
+// Start sweeps until ctx is done.
+func (sweeper *orphanSweeper) Start(ctx context.Context) error {
+	ticker := time.NewTicker(sweeper.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := sweeper.sweep(ctx); err != nil {
+				sweeper.Logger.Error(err, "couldn't sweep orphaned objects")
+			}
+		}
+	}
+}
+
+func (sweeper *orphanSweeper) sweep(ctx context.Context) error {
+	gateways := gatewayapi.GatewayList{}
+	if err := sweeper.List(ctx, &gateways); err != nil {
+		return err
+	}
+	uids := map[types.UID]bool{}
+	for i := range gateways.Items {
+		uids[gateways.Items[i].UID] = true
+	}
+	orphaned := func(obj client.Object) bool {
+		uid, ok := obj.GetLabels()[gatewayUIDLabel]
+		return ok && !uids[types.UID(uid)]
+	}
+
+	deployments := appsv1.DeploymentList{}
+	if err := sweeper.List(ctx, &deployments, client.InNamespace(sweeper.Namespace), client.HasLabels{gatewayUIDLabel}); err != nil {
+		return err
+	}
+	var orphans []client.Object
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if !orphaned(deployment) {
+			continue
+		}
+		// state Secrets created by tailscale before we created them
+		// don't have our labels
+		orphans = append(orphans, deployment, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      deployment.Name + "-state",
+				Namespace: deployment.Namespace,
+			},
+		})
+	}
+
+	secrets := v1.SecretList{}
+	if err := sweeper.List(ctx, &secrets, client.InNamespace(sweeper.Namespace), client.HasLabels{gatewayUIDLabel}); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		if orphaned(&secrets.Items[i]) {
+			orphans = append(orphans, &secrets.Items[i])
+		}
+	}
+
+	rbac, err := rbacObjects(ctx, sweeper.Client, sweeper.Namespace, client.HasLabels{gatewayUIDLabel})
+	if err != nil {
+		return err
+	}
+	for _, obj := range rbac {
+		if orphaned(obj) {
+			orphans = append(orphans, obj)
+		}
+	}
+
+	for _, orphan := range orphans {
+		sweeper.Logger.Info("deleting orphaned object", "name", orphan.GetName(), "gatewayUID", orphan.GetLabels()[gatewayUIDLabel])
+		if err := sweeper.Delete(ctx, orphan); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
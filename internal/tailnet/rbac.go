@@ -0,0 +1,131 @@
+package tailnet
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// machineClusterRole grants the machines read access to routes and their
+// backends in all namespaces and lets them report status.
+const machineClusterRole = "tailway-machine"
+
+// handleRBAC creates the ServiceAccount of the machine with fqdn together
+// with its state Secret. The ServiceAccount can only write to that Secret and
+// is bound to machineClusterRole for everything else.
+func (ctrlr *GatewayController) handleRBAC(ctx context.Context, gateway metav1.Object, fqdn, objectName string) error {
+	labels := func(obj metav1.Object) {
+		setGatewayLabels(obj, gateway)
+		obj.GetLabels()[fqdnLabel] = fqdn
+	}
+	subjects := []rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      objectName,
+		Namespace: ctrlr.Namespace,
+	}}
+
+	// only labeled with the Gateway, the fqdn label is used to find the
+	// authkey Secret
+	state := v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: objectName + "-state", Namespace: ctrlr.Namespace}}
+	if _, err := controllerutil.CreateOrPatch(ctx, ctrlr.Client, &state, func() error {
+		setGatewayLabels(&state, gateway)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	serviceAccount := v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: objectName, Namespace: ctrlr.Namespace}}
+	if _, err := controllerutil.CreateOrPatch(ctx, ctrlr.Client, &serviceAccount, func() error {
+		labels(&serviceAccount)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	role := rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: objectName, Namespace: ctrlr.Namespace}}
+	if _, err := controllerutil.CreateOrPatch(ctx, ctrlr.Client, &role, func() error {
+		labels(&role)
+		role.Rules = []rbacv1.PolicyRule{{
+			APIGroups:     []string{""},
+			Resources:     []string{"secrets"},
+			ResourceNames: []string{state.Name},
+			Verbs:         []string{"get", "update", "patch"},
+		}}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	roleBinding := rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: objectName, Namespace: ctrlr.Namespace}}
+	if _, err := controllerutil.CreateOrPatch(ctx, ctrlr.Client, &roleBinding, func() error {
+		labels(&roleBinding)
+		roleBinding.RoleRef = rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: role.Name}
+		roleBinding.Subjects = subjects
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	clusterRoleBinding := rbacv1.ClusterRoleBinding{ObjectMeta: metav1.ObjectMeta{Name: clusterRoleBindingName(ctrlr.Namespace, objectName)}}
+	if _, err := controllerutil.CreateOrPatch(ctx, ctrlr.Client, &clusterRoleBinding, func() error {
+		labels(&clusterRoleBinding)
+		clusterRoleBinding.RoleRef = rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: machineClusterRole}
+		clusterRoleBinding.Subjects = subjects
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// clusterRoleBindingName includes namespace because ClusterRoleBindings
+// aren't namespaced.
+func clusterRoleBindingName(namespace, objectName string) string {
+	return machineClusterRole + "-" + namespace + "-" + objectName
+}
+
+// rbacObjects lists the RBAC objects of machines in namespace matching opts.
+func rbacObjects(ctx context.Context, cl client.Client, namespace string, opts ...client.ListOption) ([]client.Object, error) {
+	var objects []client.Object
+
+	serviceAccounts := v1.ServiceAccountList{}
+	if err := cl.List(ctx, &serviceAccounts, append(opts, client.InNamespace(namespace))...); err != nil {
+		return nil, err
+	}
+	for i := range serviceAccounts.Items {
+		objects = append(objects, &serviceAccounts.Items[i])
+	}
+
+	roles := rbacv1.RoleList{}
+	if err := cl.List(ctx, &roles, append(opts, client.InNamespace(namespace))...); err != nil {
+		return nil, err
+	}
+	for i := range roles.Items {
+		objects = append(objects, &roles.Items[i])
+	}
+
+	roleBindings := rbacv1.RoleBindingList{}
+	if err := cl.List(ctx, &roleBindings, append(opts, client.InNamespace(namespace))...); err != nil {
+		return nil, err
+	}
+	for i := range roleBindings.Items {
+		objects = append(objects, &roleBindings.Items[i])
+	}
+
+	clusterRoleBindings := rbacv1.ClusterRoleBindingList{}
+	if err := cl.List(ctx, &clusterRoleBindings, opts...); err != nil {
+		return nil, err
+	}
+	for i := range clusterRoleBindings.Items {
+		if subjects := clusterRoleBindings.Items[i].Subjects; len(subjects) > 0 && subjects[0].Namespace == namespace {
+			objects = append(objects, &clusterRoleBindings.Items[i])
+		}
+	}
+
+	return objects, nil
+}
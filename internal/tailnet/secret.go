@@ -3,70 +3,185 @@ package tailnet
 import (
 	"context"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+
+	"github.com/michaelbeaumont/tailway/pkg"
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
 )
 
-func (ctrlr *GatewayController) handleSecret(ctx context.Context, gateway metav1.Object, class *gatewayapi.GatewayClass, fqdn string) error {
+// handleSecret makes sure the authkey Secret of the machine holds a key the
+// machine can still log in with. A new key is created when the machine isn't
+// logged in and the current key was already used or has expired. It returns
+// the ID of the current key and when the key should be checked again.
+func (ctrlr *GatewayController) handleSecret(
+	ctx context.Context,
+	list *deviceList,
+	gateway *gatewayapi.Gateway,
+	config *tailwayapi.TailwayConfig,
+	fqdn string,
+) (string, time.Duration, error) {
 	objectName := strings.ReplaceAll(fqdn, ".", "-")
 
-	secrets := v1.SecretList{}
-	if err := ctrlr.List(ctx, &secrets, client.MatchingLabels{
-		fqdnLabel: fqdn,
-	}); err != nil {
-		return err
+	existing, err := ctrlr.authKeySecret(ctx, fqdn)
+	if err != nil {
+		return "", 0, err
 	}
 
-	if len(secrets.Items) > 0 {
-		return nil
+	authkeySecret := v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      objectName + "-authkey",
+			Namespace: ctrlr.Namespace,
+		},
 	}
+	if existing != nil {
+		authkeySecret = *existing
+
+		orig := authkeySecret.DeepCopy()
+		if setGatewayLabels(&authkeySecret, gateway) {
+			if err := ctrlr.Patch(ctx, &authkeySecret, client.MergeFrom(orig)); err != nil {
+				return "", 0, err
+			}
+		}
+
+		// only a running machine reports itself as programmed
+		if meta.IsStatusConditionTrue(gateway.Status.Conditions, string(gatewayapi.GatewayConditionProgrammed)) {
+			return authkeySecret.Annotations[authKeyIDAnnotation], 0, nil
+		}
 
-	tagsAnnotation, ok := class.Annotations[tagsAnnotation]
-	tags := strings.Split(tagsAnnotation, ",")
+		devices, err := list.get(ctx)
+		if err != nil {
+			return "", 0, err
+		}
+
+		hostname := machineHostname(config, fqdn)
+		if machineLoggedIn(gateway, devices, hostname) {
+			return authkeySecret.Annotations[authKeyIDAnnotation], 0, nil
+		}
+
+		usable, recheck := authKeyUsable(devices, &authkeySecret, hostname)
+		if usable {
+			return authkeySecret.Annotations[authKeyIDAnnotation], recheck, nil
+		}
+
+		ctrlr.Logger.Info("machine isn't logged in and its authkey can't be used anymore, creating a new one", "name", fqdn)
+	}
 
 	caps := tailscale.KeyCapabilities{
 		Devices: tailscale.KeyDeviceCapabilities{
 			Create: tailscale.KeyDeviceCreateCapabilities{
 				Reusable:      false,
 				Preauthorized: true,
-				Tags:          tags,
+				Tags:          config.Spec.Tags,
 			},
 		},
 	}
 
-	ctrlr.tsClients.Lock()
-	ts, ok := ctrlr.tsClients.clients[class.Name]
-	ctrlr.tsClients.Unlock()
-	if !ok {
-		return errors.New("couldn't find TS client in map")
+	var expiry time.Duration
+	if config.Spec.AuthKeyExpiry != nil {
+		expiry = config.Spec.AuthKeyExpiry.Duration
 	}
 
-	key, _, err := ts.CreateKey(ctx, caps)
+	done := apiCall("CreateKey")
+	key, keyMeta, err := list.ts.CreateKeyWithExpiry(ctx, caps, expiry)
+	done(err)
 	if err != nil {
-		return errors.Wrap(err, "couldn't create authkey")
+		return "", 0, errors.Wrap(err, "couldn't create authkey")
 	}
 
-	authkeySecret := v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      objectName + "-authkey",
-			Namespace: "tailway-system",
-			Labels: map[string]string{
-				fqdnLabel: fqdn,
-			},
-		},
-		StringData: map[string]string{
-			"TS_AUTHKEY": key,
-		},
+	if _, err := controllerutil.CreateOrPatch(ctx, ctrlr.Client, &authkeySecret, func() error {
+		if authkeySecret.Labels == nil {
+			authkeySecret.Labels = map[string]string{}
+		}
+		authkeySecret.Labels[fqdnLabel] = fqdn
+		setGatewayLabels(&authkeySecret, gateway)
+		if authkeySecret.Annotations == nil {
+			authkeySecret.Annotations = map[string]string{}
+		}
+		authkeySecret.Annotations[authKeyIDAnnotation] = keyMeta.ID
+		authkeySecret.Annotations[authKeyCreatedAnnotation] = keyMeta.Created.Format(time.RFC3339)
+		authkeySecret.Annotations[authKeyExpiresAnnotation] = keyMeta.Expires.Format(time.RFC3339)
+		// the machine gets a new device with the new key
+		delete(authkeySecret.Annotations, deviceIDAnnotation)
+		authkeySecret.Data = map[string][]byte{
+			"TS_AUTHKEY": []byte(key),
+		}
+		return nil
+	}); err != nil {
+		return "", 0, err
+	}
+
+	return keyMeta.ID, untilExpiry(keyMeta.Expires), nil
+}
+
+// machineLoggedIn checks whether the machine of gateway is logged in, as far
+// as it reported. A machine that reports it needs to log in, because it lost
+// its state, was logged out or its node key expired, is still logged in if
+// one of devices with hostname was created since then.
+func machineLoggedIn(gateway *gatewayapi.Gateway, devices []*tailscale.Device, hostname string) bool {
+	programmed := meta.FindStatusCondition(gateway.Status.Conditions, string(gatewayapi.GatewayConditionProgrammed))
+	if programmed == nil || programmed.Status != metav1.ConditionFalse {
+		return true
+	}
+	if state, ok := pkg.ReportedBackendState(programmed.Message); !ok || state != ipn.NeedsLogin.String() {
+		return true
+	}
+
+	for _, device := range devices {
+		if device.Hostname != hostname {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, device.Created)
+		if err == nil && created.After(programmed.LastTransitionTime.Time) {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := ctrlr.Create(ctx, &authkeySecret); err != nil {
-		return err
+// authKeyUsable checks whether the key in authkeySecret hasn't expired and
+// hasn't been used by one of devices with hostname since it was created. If
+// it's usable, it also returns when it expires.
+func authKeyUsable(
+	devices []*tailscale.Device,
+	authkeySecret *v1.Secret,
+	hostname string,
+) (bool, time.Duration) {
+	// keys from before we recorded these annotations are treated as used
+	created, err := time.Parse(time.RFC3339, authkeySecret.Annotations[authKeyCreatedAnnotation])
+	if err != nil {
+		return false, 0
+	}
+	expires, err := time.Parse(time.RFC3339, authkeySecret.Annotations[authKeyExpiresAnnotation])
+	if err != nil || !expires.IsZero() && !time.Now().Before(expires) {
+		return false, 0
 	}
 
-	return nil
+	for _, device := range devices {
+		if device.Hostname != hostname {
+			continue
+		}
+		deviceCreated, err := time.Parse(time.RFC3339, device.Created)
+		if err == nil && !deviceCreated.Before(created) {
+			return false, 0
+		}
+	}
+
+	return true, untilExpiry(expires)
+}
+
+func untilExpiry(expires time.Time) time.Duration {
+	if expires.IsZero() {
+		return 0
+	}
+	return time.Until(expires) + time.Second
 }
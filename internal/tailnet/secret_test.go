@@ -0,0 +1,164 @@
+package tailnet
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+	"tailscale.com/client/tailscale"
+)
+
+// testGateway returns a Gateway with the Programmed condition the machine
+// reported at since.
+func testGateway(status metav1.ConditionStatus, message string, since time.Time) *gatewayapi.Gateway {
+	return &gatewayapi.Gateway{
+		Status: gatewayapi.GatewayStatus{
+			Conditions: []metav1.Condition{{
+				Type:               string(gatewayapi.GatewayConditionProgrammed),
+				Status:             status,
+				Reason:             string(gatewayapi.GatewayReasonPending),
+				Message:            message,
+				LastTransitionTime: metav1.NewTime(since),
+			}},
+		},
+	}
+}
+
+func testDevice(id, hostname string, created time.Time) *tailscale.Device {
+	return &tailscale.Device{
+		DeviceID:          id,
+		Hostname:          hostname,
+		Created:           created.Format(time.RFC3339),
+		KeyExpiryDisabled: true,
+	}
+}
+
+func authKeySecretAt(created, expires time.Time) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				authKeyCreatedAnnotation: created.Format(time.RFC3339),
+				authKeyExpiresAnnotation: expires.Format(time.RFC3339),
+			},
+		},
+	}
+}
+
+func TestMachineLoggedIn(t *testing.T) {
+	now := time.Now()
+	restarted := now.Add(-time.Minute)
+	oldDevice := testDevice("old", "machine", now.Add(-24*time.Hour))
+
+	cases := []struct {
+		name    string
+		gateway *gatewayapi.Gateway
+		devices []*tailscale.Device
+		want    bool
+	}{{
+		name:    "nothing reported yet",
+		gateway: &gatewayapi.Gateway{},
+		want:    true,
+	}, {
+		name:    "programmed",
+		gateway: testGateway(metav1.ConditionTrue, "", restarted),
+		devices: []*tailscale.Device{oldDevice},
+		want:    true,
+	}, {
+		name:    "starting",
+		gateway: testGateway(metav1.ConditionFalse, "tailscale is in state Starting", restarted),
+		devices: []*tailscale.Device{oldDevice},
+		want:    true,
+	}, {
+		name:    "waiting for the machine",
+		gateway: testGateway(metav1.ConditionFalse, "waiting for the machine", restarted),
+		want:    true,
+	}, {
+		name:    "lost state",
+		gateway: testGateway(metav1.ConditionFalse, "tailscale is in state NeedsLogin", restarted),
+		devices: []*tailscale.Device{oldDevice},
+	}, {
+		name:    "lost state with health messages",
+		gateway: testGateway(metav1.ConditionFalse, "tailscale is in state NeedsLogin: not logged in", restarted),
+		devices: []*tailscale.Device{oldDevice},
+	}, {
+		name:    "no devices",
+		gateway: testGateway(metav1.ConditionFalse, "tailscale is in state NeedsLogin", restarted),
+	}, {
+		name:    "logged in since",
+		gateway: testGateway(metav1.ConditionFalse, "tailscale is in state NeedsLogin", restarted),
+		devices: []*tailscale.Device{oldDevice, testDevice("new", "machine", now)},
+		want:    true,
+	}, {
+		name:    "other machine logged in since",
+		gateway: testGateway(metav1.ConditionFalse, "tailscale is in state NeedsLogin", restarted),
+		devices: []*tailscale.Device{oldDevice, testDevice("other", "other", now)},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := machineLoggedIn(tc.gateway, tc.devices, "machine"); got != tc.want {
+				t.Errorf("got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthKeyUsable(t *testing.T) {
+	now := time.Now()
+	keyCreated := now.Add(-time.Hour)
+
+	cases := []struct {
+		name    string
+		secret  *v1.Secret
+		devices []*tailscale.Device
+		want    bool
+	}{{
+		name:   "unused",
+		secret: authKeySecretAt(keyCreated, now.Add(time.Hour)),
+		devices: []*tailscale.Device{
+			testDevice("old", "machine", keyCreated.Add(-time.Hour)),
+		},
+		want: true,
+	}, {
+		name:   "never expires",
+		secret: authKeySecretAt(keyCreated, time.Time{}),
+		want:   true,
+	}, {
+		name:   "used",
+		secret: authKeySecretAt(keyCreated, now.Add(time.Hour)),
+		devices: []*tailscale.Device{
+			testDevice("new", "machine", keyCreated.Add(time.Minute)),
+		},
+	}, {
+		// the device that used the key is still around after the machine
+		// lost its state
+		name:   "used before losing state",
+		secret: authKeySecretAt(keyCreated, time.Time{}),
+		devices: []*tailscale.Device{
+			testDevice("old", "machine", keyCreated.Add(time.Minute)),
+		},
+	}, {
+		name:   "used by another machine",
+		secret: authKeySecretAt(keyCreated, now.Add(time.Hour)),
+		devices: []*tailscale.Device{
+			testDevice("other", "other", keyCreated.Add(time.Minute)),
+		},
+		want: true,
+	}, {
+		name:   "expired",
+		secret: authKeySecretAt(keyCreated, now.Add(-time.Minute)),
+	}, {
+		name:   "without annotations",
+		secret: &v1.Secret{},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, _ := authKeyUsable(tc.devices, tc.secret, "machine"); got != tc.want {
+				t.Errorf("got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
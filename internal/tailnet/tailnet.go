@@ -3,28 +3,75 @@ package tailnet
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
 	"tailscale.com/client/tailscale"
+
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
 )
 
 const tokenURL = "https://login.tailscale.com/api/v2/oauth/token"
 const fqdnLabel = "tailway.michaelbeaumont.github.io/node-fqdn"
-const tagsAnnotation = "tailway.michaelbeaumont.github.io/tags"
+const gatewayFinalizer = "tailway.michaelbeaumont.github.io/machine"
+const authKeyIDAnnotation = "tailway.michaelbeaumont.github.io/authkey-id"
+const authKeyCreatedAnnotation = "tailway.michaelbeaumont.github.io/authkey-created"
+const authKeyExpiresAnnotation = "tailway.michaelbeaumont.github.io/authkey-expires"
+const deviceIDAnnotation = "tailway.michaelbeaumont.github.io/device-id"
+const deviceDeletedCondition = "tailway.michaelbeaumont.github.io/DeviceDeleted"
 
 const clientIDFile = "/oauth/client_id"
 const clientSecretFile = "/oauth/client_secret"
 
+// TSClients holds a client per GatewayClass. It's only filled in by the
+// leader, so a new leader has to rebuild clients it needs before the
+// GatewayClassController got to them.
 type TSClients struct {
 	clients map[string]*tailscale.Client
 	sync.Mutex
 }
 
-func FromBuilder(logger logr.Logger, mgr manager.Manager) error {
+// forClass returns the client of class, creating it from the TailwayConfig of
+// class in namespace if there isn't one yet.
+func (c *TSClients) forClass(
+	ctx context.Context,
+	cl client.Client,
+	namespace string,
+	class *gatewayapi.GatewayClass,
+) (*tailscale.Client, error) {
+	c.Lock()
+	ts, ok := c.clients[class.Name]
+	c.Unlock()
+	if ok {
+		return ts, nil
+	}
+
+	ts, err := clientForClass(ctx, cl, namespace, class)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create TS client")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	// the GatewayClassController may have been faster
+	if existing, ok := c.clients[class.Name]; ok {
+		return existing, nil
+	}
+	c.clients[class.Name] = ts
+	return ts, nil
+}
+
+// FromBuilder sets up the controllers managing machines in namespace.
+func FromBuilder(logger logr.Logger, mgr manager.Manager, namespace string) error {
 	tailscale.I_Acknowledge_This_API_Is_Unstable = true
 
 	logger = logger.WithName("tailnet")
@@ -36,9 +83,18 @@ func FromBuilder(logger logr.Logger, mgr manager.Manager) error {
 	if err := builder.
 		ControllerManagedBy(mgr).
 		For(&gatewayapi.GatewayClass{}).
+		Watches(
+			&tailwayapi.TailwayConfig{},
+			handler.EnqueueRequestsFromMapFunc(classesForConfig(logger, mgr.GetClient())),
+		).
+		Watches(
+			&v1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(classesForSecret(logger, mgr.GetClient())),
+		).
 		Complete(&GatewayClassController{
 			Client:    mgr.GetClient(),
 			Logger:    logger.WithValues("resource", "GatewayClass"),
+			Namespace: namespace,
 			tsClients: &clients,
 		}); err != nil {
 		return err
@@ -52,18 +108,48 @@ func FromBuilder(logger logr.Logger, mgr manager.Manager) error {
 
 	if err := builder.
 		ControllerManagedBy(mgr).
-		For(&gatewayapi.Gateway{}).
+		For(&gatewayapi.Gateway{}, builder.WithPredicates(predicate.Or(
+			predicate.GenerationChangedPredicate{},
+			predicate.AnnotationChangedPredicate{},
+			machineReportChanged(),
+		))).
 		Watches(
 			&gatewayapi.GatewayClass{},
 			handler.EnqueueRequestsFromMapFunc(gatewaysForClass(logger, mgr.GetClient())),
 		).
+		Watches(
+			&tailwayapi.TailwayConfig{},
+			handler.EnqueueRequestsFromMapFunc(gatewaysForConfig(logger, mgr.GetClient())),
+		).
+		Watches(
+			&appsv1.Deployment{},
+			handler.EnqueueRequestsFromMapFunc(gatewaysForMachineObject(logger, mgr.GetClient(), namespace)),
+		).
+		Watches(
+			&v1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(gatewaysForMachineObject(logger, mgr.GetClient(), namespace)),
+		).
 		Complete(&GatewayController{
 			Client:    mgr.GetClient(),
 			Logger:    logger.WithValues("resource", "Gateway"),
+			Namespace: namespace,
 			tsClients: &clients,
 		}); err != nil {
 		return err
 	}
 
+	if err := registerMetrics(mgr.GetClient()); err != nil {
+		return err
+	}
+
+	if err := mgr.Add(&orphanSweeper{
+		Client:    mgr.GetClient(),
+		Logger:    logger.WithName("orphanSweeper"),
+		Namespace: namespace,
+		Interval:  10 * time.Minute,
+	}); err != nil {
+		return err
+	}
+
 	return nil
 }
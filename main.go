@@ -1,9 +1,17 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
+	"strings"
 
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -13,47 +21,217 @@ import (
 
 	"github.com/michaelbeaumont/tailway/internal/machine"
 	"github.com/michaelbeaumont/tailway/internal/tailnet"
+	"github.com/michaelbeaumont/tailway/pkg"
+	tailwayapi "github.com/michaelbeaumont/tailway/pkg/apis/v1alpha1"
 )
 
-func main() {
-	logf.SetLogger(zap.New())
+const usage = `Usage: tailway <command> [flags]
 
-	var logger = logf.Log.WithName("tailway")
+Commands:
+  tailnet  manage a machine for every Gateway of a tailway GatewayClass
+  machine  serve the routes of a single Gateway, runs next to tailscaled
 
-	mgr, err := manager.New(config.GetConfigOrDie(), manager.Options{})
-	if err != nil {
-		logger.Error(err, "could not create manager")
-		os.Exit(1)
+Run 'tailway <command> -h' for the flags of a command.
+`
+
+// commonFlags are shared by all commands.
+type commonFlags struct {
+	metricsAddr     string
+	healthProbeAddr string
+	logLevel        string
+	logFormat       string
+	watchNamespaces string
+}
+
+func (common *commonFlags) bind(flags *flag.FlagSet) {
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: tailway %s [flags]\n\nFlags:\n", flags.Name())
+		flags.PrintDefaults()
 	}
+	flags.StringVar(&common.metricsAddr, "metrics-bind-address", ":8080", "address the metrics endpoint binds to, 0 disables it")
+	flags.StringVar(&common.healthProbeAddr, "health-probe-bind-address", fmt.Sprintf(":%d", pkg.HealthProbePort), "address the health probe endpoint binds to")
+	flags.StringVar(&common.logLevel, "log-level", "info", "log level, one of debug, info, warn or error")
+	flags.StringVar(&common.logFormat, "log-format", "json", "log format, either json or console")
+	flags.StringVar(&common.watchNamespaces, "watch-namespaces", "", "comma separated namespaces to watch, all if empty")
+}
 
-	gatewayapi.Install(mgr.GetScheme())
-	gatewayapi_alpha.Install(mgr.GetScheme())
+// logger validates the log flags and builds the logger from them.
+func (common *commonFlags) logger() (logr.Logger, error) {
+	level, err := zapcore.ParseLevel(common.logLevel)
+	if err != nil || level > zapcore.ErrorLevel {
+		return logr.Logger{}, errors.Errorf("invalid --log-level %q", common.logLevel)
+	}
 
-	if len(os.Args) != 2 {
-		logger.Error(nil, "expected either 'machine' or 'tailnet' as first argument")
-		os.Exit(1)
+	opts := []zap.Opts{zap.Level(level)}
+	switch common.logFormat {
+	case "json":
+		opts = append(opts, zap.JSONEncoder())
+	case "console":
+		opts = append(opts, zap.ConsoleEncoder())
+	default:
+		return logr.Logger{}, errors.Errorf("invalid --log-format %q", common.logFormat)
 	}
 
-	switch os.Args[1] {
-	case "machine":
-		if err := machine.FromBuilder(logger, mgr); err != nil {
-			logger.Error(err, "could not create machine controller")
-			os.Exit(1)
+	return zap.New(opts...), nil
+}
+
+// options returns the manager options for the common flags, additionally
+// watching extraNamespaces if only some namespaces are watched.
+func (common *commonFlags) options(extraNamespaces ...string) manager.Options {
+	options := manager.Options{
+		MetricsBindAddress:     common.metricsAddr,
+		HealthProbeBindAddress: common.healthProbeAddr,
+	}
+	if common.watchNamespaces != "" {
+		namespaces := append([]string{}, extraNamespaces...)
+		for _, namespace := range strings.Split(common.watchNamespaces, ",") {
+			if namespace = strings.TrimSpace(namespace); namespace != "" {
+				namespaces = append(namespaces, namespace)
+			}
 		}
-		logger.Info("Starting machine")
+		options.Cache = cache.Options{Namespaces: namespaces}
+	}
+	return options
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
 	case "tailnet":
-		if err := tailnet.FromBuilder(logger, mgr); err != nil {
-			logger.Error(err, "could not create tailnet controller")
-			os.Exit(1)
-		}
-		logger.Info("Starting tailnet")
+		err = runTailnet(os.Args[2:])
+	case "machine":
+		err = runMachine(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		flag.Usage()
+		return
 	default:
-		logger.Error(nil, "expected either 'machine' or 'tailnet' as first argument")
+		fmt.Fprintf(flag.CommandLine.Output(), "unknown command %q\n\n", os.Args[1])
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+}
 
-	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
-		logger.Error(err, "could not start manager")
-		os.Exit(1)
+func runTailnet(args []string) error {
+	flags := flag.NewFlagSet("tailnet", flag.ExitOnError)
+
+	common := commonFlags{}
+	common.bind(flags)
+
+	defaultNamespace := os.Getenv("POD_NAMESPACE")
+	if defaultNamespace == "" {
+		defaultNamespace = "tailway-system"
+	}
+	namespace := flags.String("namespace", defaultNamespace, "namespace of tailway, where machines are created")
+	leaderElect := flags.Bool("leader-elect", false, "elect a leader among tailnet controller replicas")
+	leaderElectionNamespace := flags.String("leader-election-namespace", "", "namespace of the leader election lease, defaults to --namespace")
+	leaderElectionID := flags.String("leader-election-id", "tailway-tailnet", "name of the leader election lease")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.Errorf("unexpected arguments %v", flags.Args())
+	}
+	if *namespace == "" {
+		return errors.New("--namespace must not be empty")
+	}
+
+	// the machines and TailwayConfigs are always in our namespace
+	options := common.options(*namespace)
+	if *leaderElect {
+		options.LeaderElection = true
+		options.LeaderElectionID = *leaderElectionID
+		options.LeaderElectionNamespace = *leaderElectionNamespace
+		if options.LeaderElectionNamespace == "" {
+			options.LeaderElectionNamespace = *namespace
+		}
+		options.LeaderElectionReleaseOnCancel = true
+	}
+
+	logger, mgr, err := newManager(&common, options)
+	if err != nil {
+		return err
+	}
+
+	if err := tailnet.FromBuilder(logger, mgr, *namespace); err != nil {
+		return errors.Wrap(err, "could not create tailnet controller")
+	}
+
+	logger.Info("Starting tailnet")
+	return errors.Wrap(mgr.Start(signals.SetupSignalHandler()), "could not start manager")
+}
+
+func runMachine(args []string) error {
+	flags := flag.NewFlagSet("machine", flag.ExitOnError)
+
+	common := commonFlags{}
+	common.bind(flags)
+
+	socket := flags.String("tailscaled-socket", "", "path of the tailscaled socket, defaults to the platform's default")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	logger, mgr, err := newManager(&common, common.options())
+	if err != nil {
+		return err
 	}
+
+	if err := machine.FromBuilder(logger, mgr, *socket); err != nil {
+		return errors.Wrap(err, "could not create machine controller")
+	}
+
+	logger.Info("Starting machine")
+	return errors.Wrap(mgr.Start(signals.SetupSignalHandler()), "could not start manager")
+}
+
+// newManager sets up logging and creates a manager with all our APIs
+// installed.
+func newManager(common *commonFlags, options manager.Options) (logr.Logger, manager.Manager, error) {
+	logger, err := common.logger()
+	if err != nil {
+		return logr.Logger{}, nil, err
+	}
+	logf.SetLogger(logger)
+	logger = logger.WithName("tailway")
+
+	mgr, err := manager.New(config.GetConfigOrDie(), options)
+	if err != nil {
+		return logr.Logger{}, nil, errors.Wrap(err, "could not create manager")
+	}
+
+	if err := gatewayapi.Install(mgr.GetScheme()); err != nil {
+		return logr.Logger{}, nil, err
+	}
+	if err := gatewayapi_alpha.Install(mgr.GetScheme()); err != nil {
+		return logr.Logger{}, nil, err
+	}
+	if err := tailwayapi.Install(mgr.GetScheme()); err != nil {
+		return logr.Logger{}, nil, errors.Wrap(err, "could not install tailway API")
+	}
+
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return logr.Logger{}, nil, err
+	}
+	if err := mgr.AddReadyzCheck("ping", healthz.Ping); err != nil {
+		return logr.Logger{}, nil, err
+	}
+
+	return logger, mgr, nil
 }
@@ -0,0 +1,21 @@
+// Package v1alpha1 contains the tailway.michaelbeaumont.github.io API, which
+// holds the configuration GatewayClasses refer to with parametersRef.
+// +kubebuilder:object:generate=true
+// +groupName=tailway.michaelbeaumont.github.io
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+const GroupName = "tailway.michaelbeaumont.github.io"
+
+var (
+	GroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// Install adds the types of this group to a scheme.
+	Install = SchemeBuilder.AddToScheme
+)
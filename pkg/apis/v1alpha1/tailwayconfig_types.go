@@ -0,0 +1,112 @@
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const TailwayConfigKind = "TailwayConfig"
+
+// TailwayConfig configures the tailnet and the machines of a GatewayClass
+// that refers to it with parametersRef.
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Namespaced
+type TailwayConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TailwayConfigSpec `json:"spec"`
+}
+
+type TailwayConfigSpec struct {
+	// OAuthSecretRef refers to a Secret in the namespace of the
+	// TailwayConfig holding client_id and client_secret of a Tailscale
+	// OAuth client.
+	OAuthSecretRef v1.LocalObjectReference `json:"oauthSecretRef"`
+	// Tailnet is the name of the tailnet, defaults to the tailnet of the
+	// OAuth client.
+	// +optional
+	Tailnet string `json:"tailnet,omitempty"`
+	// Tags are given to every machine, they must be owned by the OAuth
+	// client.
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+	// AuthKeyExpiry is how long the authkeys created for machines are
+	// valid, defaults to the default of the tailnet. Machines that aren't
+	// logged in get a new key once theirs expires.
+	// +optional
+	AuthKeyExpiry *metav1.Duration `json:"authKeyExpiry,omitempty"`
+	// HostnamePrefix is prepended to the tailscale hostname of every
+	// machine.
+	// +optional
+	HostnamePrefix string `json:"hostnamePrefix,omitempty"`
+	// DeleteStaleDevices removes offline devices with the same tags that
+	// hold the hostname of a machine, which would otherwise get a suffixed
+	// name. Requires Tags.
+	// +optional
+	DeleteStaleDevices bool `json:"deleteStaleDevices,omitempty"`
+	// ProxyImage is the tailscale image the machines run, defaults to
+	// ghcr.io/tailscale/tailscale.
+	// +optional
+	ProxyImage string `json:"proxyImage,omitempty"`
+	// ProxyImagePullPolicy is the pull policy of ProxyImage.
+	// +optional
+	ProxyImagePullPolicy v1.PullPolicy `json:"proxyImagePullPolicy,omitempty"`
+	// TailscaleVersion pins the tag of ProxyImage, which then can't have a
+	// tag itself. Defaults to latest.
+	// +optional
+	TailscaleVersion string `json:"tailscaleVersion,omitempty"`
+	// MachineImage is the tailway image that runs next to tailscale on the
+	// machines, defaults to michaelbeaumont/tailway:latest.
+	// +optional
+	MachineImage string `json:"machineImage,omitempty"`
+	// MachineImagePullPolicy is the pull policy of MachineImage.
+	// +optional
+	MachineImagePullPolicy v1.PullPolicy `json:"machineImagePullPolicy,omitempty"`
+	// ImagePullSecrets are used by the machines to pull their images.
+	// +optional
+	ImagePullSecrets []v1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	// Resources of the tailscale container of the machines.
+	// +optional
+	Resources v1.ResourceRequirements `json:"resources,omitempty"`
+	// PodTemplatePatch is a strategic merge patch applied to the pod
+	// template of the machines, e.g. to set nodeSelectors, tolerations or a
+	// securityContext.
+	// +optional
+	// +kubebuilder:pruning:PreserveUnknownFields
+	PodTemplatePatch *runtime.RawExtension `json:"podTemplatePatch,omitempty"`
+	// Node configures tailscale on the machines.
+	// +optional
+	Node NodeOptions `json:"node,omitempty"`
+}
+
+type NodeOptions struct {
+	// AcceptRoutes makes the machines use subnet routes advertised by other
+	// nodes.
+	// +optional
+	AcceptRoutes bool `json:"acceptRoutes,omitempty"`
+	// AcceptDNS makes the machines use the DNS configuration of the tailnet.
+	// +optional
+	AcceptDNS bool `json:"acceptDNS,omitempty"`
+	// Userspace runs tailscale with userspace networking, which doesn't
+	// need the NET_ADMIN capability. Routes are still served but the
+	// machines can't reach the tailnet from the cluster.
+	// +optional
+	Userspace bool `json:"userspace,omitempty"`
+	// ExtraArgs are passed to tailscale up.
+	// +optional
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+}
+
+// TailwayConfigList contains a list of TailwayConfig.
+// +kubebuilder:object:root=true
+type TailwayConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TailwayConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TailwayConfig{}, &TailwayConfigList{})
+}
@@ -1,3 +1,60 @@
 package pkg
 
+import (
+	"fmt"
+	"strings"
+
+	gatewayapi "sigs.k8s.io/gateway-api/apis/v1beta1"
+)
+
 const ControllerName = "tailway.michaelbeaumont.github.io/controller"
+
+// FunnelAnnotation on a Gateway lists the names of the listeners that are
+// exposed to the internet with Tailscale Funnel, * selects all of them.
+const FunnelAnnotation = "tailway.michaelbeaumont.github.io/funnel"
+
+// HealthProbePort is the default port of the health probe endpoint, which is
+// what the probes of the machines use.
+const HealthProbePort = 8081
+
+// GatewayNamespaceEnv and GatewayNameEnv tell a machine which Gateway it
+// serves.
+const (
+	GatewayNamespaceEnv = "TAILWAY_GATEWAY_NAMESPACE"
+	GatewayNameEnv      = "TAILWAY_GATEWAY_NAME"
+)
+
+// backendStatePrefix starts the message of the Programmed condition a machine
+// reports while tailscale isn't running.
+const backendStatePrefix = "tailscale is in state "
+
+// BackendStateMessage returns the message a machine reports while tailscale is
+// in state.
+func BackendStateMessage(state string) string {
+	return backendStatePrefix + state
+}
+
+// ReportedBackendState returns the state of tailscale a machine reported in
+// message, the message of its Gateway's Programmed condition.
+func ReportedBackendState(message string) (string, bool) {
+	state, ok := strings.CutPrefix(message, backendStatePrefix)
+	if !ok {
+		return "", false
+	}
+	if i := strings.IndexAny(state, ",:"); i >= 0 {
+		state = state[:i]
+	}
+	return state, true
+}
+
+// GatewayHostname returns the tailscale hostname of the machine for gateway,
+// which can be set with a Hostname address and defaults to <name>-<namespace>.
+func GatewayHostname(gateway *gatewayapi.Gateway) string {
+	hostname := fmt.Sprintf("%s-%s", gateway.Name, gateway.Namespace)
+	for _, address := range gateway.Spec.Addresses {
+		if *address.Type == gatewayapi.HostnameAddressType {
+			hostname = address.Value
+		}
+	}
+	return hostname
+}